@@ -0,0 +1,278 @@
+package uwsgi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Admin is a http.Handler serving JSON API for runtime control of Proxy. It
+// has no authentication, so it's meant to be served on a separate listener
+// bound to a loopback or otherwise private address:
+//
+//	admin := &uwsgi.Admin{Proxy: p, Balancer: b}
+//	go http.ListenAndServe("localhost:6060", admin)
+//
+// It serves the following endpoints:
+//
+//	GET /config — Proxy configuration and runtime state, including
+//		PoolStats
+//	GET /backends — list of BackendStatus
+//	PUT /backends — enable or disable Balancer backend, e.g.
+//		{"addr": "10.0.0.2:3031", "disabled": true}
+//	POST /cache/flush — flush Caches
+//	GET, PUT /maintenance — maintenance mode, e.g.
+//		{"on": true, "retryAfter": 60}, see Proxy.SetMaintenance
+//	GET, PUT /read-only — read-only mode in the same format, see
+//		Proxy.SetReadOnly
+//	GET, PUT /log-level — log level, e.g. {"level": "debug"}, see
+//		Proxy.SetLogLevel
+//	GET, PUT, DELETE /faults — faults injected by Proxy.Faults, if set, see
+//		FaultInjector
+//	GET, PUT /routing — backends and routes as RoutingConfig, PUT replies
+//		with RoutingDiff of changes made, see Apply; with "dry-run"
+//		query parameter set, changes are validated and reported, but not
+//		applied
+//
+// Other PUT requests reply with the new state in the same format as GET
+// requests.
+type Admin struct {
+	Proxy *Proxy
+
+	// Balancer, if set, is reported and controlled by /backends endpoint,
+	// otherwise it reports Proxy backend status.
+	Balancer *Balancer
+
+	// Caches are flushed by /cache/flush endpoint, e.g. HostRouter or
+	// Idempotency.
+	Caches []interface{ Flush() }
+
+	// Tenants, if set, gets routes applied with Apply.
+	Tenants *TenantRouter
+
+	// NewDial, if set, returns dialer for backends added with Apply. If
+	// nil, Dial is used as with Balancer.Add.
+	NewDial func(addr string) DialFunc
+
+	// NewHandler, if set, returns handler for routes applied with Apply.
+	// If nil, Proxy with dialer from NewDial and limits from RouteConfig is
+	// used. Handlers of replaced and removed routes get their
+	// CloseIdleConnections method called, if they have one.
+	NewHandler func(key string, rc RouteConfig) http.Handler
+
+	// RemoveGrace is how long backends removed with Apply can finish
+	// requests in flight, see Balancer.Remove. If zero, 30 seconds is
+	// used.
+	RemoveGrace time.Duration
+
+	mu      sync.Mutex
+	applied *RoutingConfig
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/config":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJSON(w, adminConfig{Proxy: configView(a.Proxy), State: a.state()})
+		}
+	case "/backends":
+		a.backends(w, r)
+	case "/cache/flush":
+		if allowMethods(w, r, http.MethodPost) {
+			for _, c := range a.Caches {
+				c.Flush()
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case "/maintenance":
+		a.mode(w, r, a.Proxy.Maintenance, a.Proxy.SetMaintenance)
+	case "/read-only":
+		a.mode(w, r, a.Proxy.ReadOnly, a.Proxy.SetReadOnly)
+	case "/routing":
+		a.serveRouting(w, r)
+	case "/faults":
+		if a.Proxy.Faults == nil {
+			http.Error(w, "fault injection is not enabled", http.StatusNotFound)
+			return
+		}
+		a.Proxy.Faults.ServeHTTP(w, r)
+	case "/log-level":
+		if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		var v struct {
+			Level LogLevel `json:"level"`
+		}
+		if r.Method == http.MethodPut {
+			if !readJSON(w, r, &v) {
+				return
+			}
+			a.Proxy.SetLogLevel(v.Level)
+		}
+		v.Level = a.Proxy.LogLevel()
+		writeJSON(w, v)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type adminConfig struct {
+	Proxy map[string]interface{} `json:"proxy"`
+	State adminState             `json:"state"`
+}
+
+type adminState struct {
+	ReadOnly    bool      `json:"readOnly"`
+	Maintenance bool      `json:"maintenance"`
+	Draining    bool      `json:"draining"`
+	LogLevel    LogLevel  `json:"logLevel"`
+	Pool        PoolStats `json:"pool"`
+}
+
+func (a *Admin) state() adminState {
+	return adminState{
+		ReadOnly:    a.Proxy.ReadOnly(),
+		Maintenance: a.Proxy.Maintenance(),
+		Draining:    a.Proxy.isDraining(),
+		LogLevel:    a.Proxy.LogLevel(),
+		Pool:        a.Proxy.PoolStats(),
+	}
+}
+
+func (a *Admin) backends(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if a.Balancer == nil {
+		if r.Method == http.MethodPut {
+			http.Error(w, "no Balancer configured", http.StatusConflict)
+			return
+		}
+		writeJSON(w, []BackendStatus{a.Proxy.BackendStatus()})
+		return
+	}
+	if r.Method == http.MethodPut {
+		var v struct {
+			Addr     string `json:"addr"`
+			Disabled bool   `json:"disabled"`
+		}
+		if !readJSON(w, r, &v) {
+			return
+		}
+		if !a.Balancer.SetDisabled(v.Addr, v.Disabled) {
+			http.Error(w, "unknown backend", http.StatusNotFound)
+			return
+		}
+	}
+	writeJSON(w, a.Balancer.BackendStatus())
+}
+
+func (a *Admin) serveRouting(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method != http.MethodPut {
+		writeJSON(w, a.Routing())
+		return
+	}
+	var c RoutingConfig
+	if !readJSON(w, r, &c) {
+		return
+	}
+	_, dryRun := r.URL.Query()["dry-run"]
+	d, err := a.Apply(c, dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if !dryRun && !d.Empty() {
+		logFunc(r)("uwsgi routing applied: %v", d)
+	}
+	writeJSON(w, d)
+}
+
+// mode serves endpoint reporting mode with get, and switching it with set.
+func (a *Admin) mode(w http.ResponseWriter, r *http.Request, get func() bool, set func(bool, time.Duration)) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	var v struct {
+		On         bool `json:"on"`
+		RetryAfter int  `json:"retryAfter,omitempty"` // seconds
+	}
+	if r.Method == http.MethodPut {
+		if !readJSON(w, r, &v) {
+			return
+		}
+		if v.RetryAfter < 0 {
+			http.Error(w, "retryAfter must not be negative", http.StatusBadRequest)
+			return
+		}
+		set(v.On, time.Duration(v.RetryAfter)*time.Second)
+	}
+	writeJSON(w, struct {
+		On bool `json:"on"`
+	}{get()})
+}
+
+// configView returns exported fields of p with non-zero values in a form
+// suitable for JSON encoding: functions, interfaces, and pointers are
+// reported as true, durations are formatted as strings.
+func configView(p *Proxy) map[string]interface{} {
+	out := make(map[string]interface{})
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f, fv := v.Type().Field(i), v.Field(i)
+		if !f.IsExported() || fv.IsZero() {
+			continue
+		}
+		switch {
+		case fv.Type() == reflect.TypeOf(time.Duration(0)):
+			out[f.Name] = time.Duration(fv.Int()).String()
+		case fv.Kind() == reflect.Func, fv.Kind() == reflect.Interface,
+			fv.Kind() == reflect.Chan, fv.Kind() == reflect.Pointer:
+			out[f.Name] = true
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Func:
+			out[f.Name] = fv.Len()
+		default:
+			out[f.Name] = fv.Interface()
+		}
+	}
+	return out
+}
+
+// allowMethods reports whether request method is one of methods, otherwise
+// it replies with 405 Method Not Allowed status. GET implies HEAD.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	allow := ""
+	for _, m := range methods {
+		if r.Method == m || (m == http.MethodGet && r.Method == http.MethodHead) {
+			return true
+		}
+		if allow != "" {
+			allow += ", "
+		}
+		allow += m
+	}
+	w.Header().Set("Allow", allow)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+// readJSON decodes request body into v, replying with 400 Bad Request status
+// if it fails.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,134 @@
+package uwsgi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminDo sends request to admin, returning response recorder.
+func adminDo(admin http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	return w
+}
+
+type flushCounter struct{ n int }
+
+func (c *flushCounter) Flush() { c.n++ }
+
+func TestAdmin(t *testing.T) {
+	cache := new(flushCounter)
+	p := &Proxy{DialContext: new(testBackend).dial, MaxIdleConns: 2, IdleConnTimeout: time.Minute}
+	admin := &Admin{Proxy: p, Caches: []interface{ Flush() }{cache}}
+	for _, tc := range []struct {
+		method, target, body string
+		code                 int
+		want                 string // expected body, if set
+	}{
+		{method: "GET", target: "/maintenance", code: 200, want: `{"on":false}`},
+		{method: "PUT", target: "/maintenance", body: `{"on": true, "retryAfter": 60}`, code: 200, want: `{"on":true}`},
+		{method: "PUT", target: "/maintenance", body: `{"on": true, "retryAfter": -1}`, code: 400},
+		{method: "PUT", target: "/maintenance", body: `{"on": tru`, code: 400},
+		{method: "POST", target: "/maintenance", code: 405},
+		{method: "PUT", target: "/read-only", body: `{"on": true}`, code: 200, want: `{"on":true}`},
+		{method: "GET", target: "/read-only", code: 200, want: `{"on":true}`},
+		{method: "PUT", target: "/log-level", body: `{"level": "debug"}`, code: 200, want: `{"level":"debug"}`},
+		{method: "PUT", target: "/log-level", body: `{"level": "verbose"}`, code: 400},
+		{method: "GET", target: "/log-level", code: 200, want: `{"level":"debug"}`},
+		{method: "GET", target: "/cache/flush", code: 405},
+		{method: "POST", target: "/cache/flush", code: 204},
+		{method: "PUT", target: "/backends", body: `{"addr": "a", "disabled": true}`, code: 409},
+		{method: "GET", target: "/faults", code: 404},
+		{method: "GET", target: "/unknown", code: 404},
+	} {
+		w := adminDo(admin, tc.method, tc.target, tc.body)
+		if w.Code != tc.code {
+			t.Fatalf("%s %s: got status %d, want %d: %s", tc.method, tc.target, w.Code, tc.code, w.Body)
+		}
+		if tc.want != "" && strings.TrimSpace(w.Body.String()) != tc.want {
+			t.Fatalf("%s %s: got %s, want %s", tc.method, tc.target, w.Body, tc.want)
+		}
+	}
+	if !p.Maintenance() || !p.ReadOnly() || p.LogLevel() != LogDebug {
+		t.Fatal("modes set with admin API are not applied")
+	}
+	if cache.n != 1 {
+		t.Fatalf("cache flushed %d times, want 1", cache.n)
+	}
+	if w := adminDo(admin, "POST", "/cache/flush", ""); w.Header().Get("Allow") != "" {
+		t.Fatalf("unexpected Allow header %q", w.Header().Get("Allow"))
+	}
+	if w := adminDo(admin, "DELETE", "/log-level", ""); w.Header().Get("Allow") != "GET, PUT" {
+		t.Fatalf("got Allow header %q, want %q", w.Header().Get("Allow"), "GET, PUT")
+	}
+
+	w := adminDo(admin, "GET", "/config", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("/config: got status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var cfg struct {
+		Proxy map[string]interface{} `json:"proxy"`
+		State adminState             `json:"state"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	wantProxy := map[string]interface{}{
+		"DialContext":     true,
+		"MaxIdleConns":    float64(2),
+		"IdleConnTimeout": "1m0s",
+	}
+	if !reflect.DeepEqual(cfg.Proxy, wantProxy) {
+		t.Fatalf("/config: got proxy %v, want %v", cfg.Proxy, wantProxy)
+	}
+	if want := (adminState{ReadOnly: true, Maintenance: true, LogLevel: LogDebug}); cfg.State != want {
+		t.Fatalf("/config: got state %+v, want %+v", cfg.State, want)
+	}
+
+	var backends []BackendStatus
+	w = adminDo(admin, "GET", "/backends", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &backends); err != nil {
+		t.Fatal(err)
+	}
+	if len(backends) != 1 || !backends[0].Healthy {
+		t.Fatalf("/backends: got %+v", backends)
+	}
+}
+
+func TestAdminBackends(t *testing.T) {
+	b := NewBalancer(BalanceRoundRobin, "10.0.0.1:3031", "10.0.0.2:3031")
+	admin := &Admin{Proxy: &Proxy{DialContext: b.DialContext}, Balancer: b}
+	w := adminDo(admin, "PUT", "/backends", `{"addr": "10.0.0.2:3031", "disabled": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var backends []BackendStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &backends); err != nil {
+		t.Fatal(err)
+	}
+	var disabled []string
+	for _, st := range backends {
+		if st.Disabled {
+			disabled = append(disabled, st.Addr)
+		}
+	}
+	if !reflect.DeepEqual(disabled, []string{"10.0.0.2:3031"}) {
+		t.Fatalf("got disabled backends %q", disabled)
+	}
+	if w := adminDo(admin, "PUT", "/backends", `{"addr": "10.0.0.3:3031", "disabled": true}`); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown backend: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminFaults(t *testing.T) {
+	admin := &Admin{Proxy: &Proxy{Faults: new(FaultInjector)}}
+	if w := adminDo(admin, "GET", "/faults", ""); w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+}
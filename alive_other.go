@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package uwsgi
+
+import "net"
+
+// connAlive reports whether idle connection can be reused; on this platform
+// it can't be checked cheaply, so connections are assumed to be alive.
+func connAlive(net.Conn) bool { return true }
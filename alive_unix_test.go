@@ -0,0 +1,99 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package uwsgi
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConnAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !connAlive(conn) {
+		t.Fatal("open idle connection is reported dead")
+	}
+	io.WriteString(peer, "x")
+	if !waitDead(conn) {
+		t.Fatal("connection with unexpected data is reported alive")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if !connAlive(conn) {
+		t.Fatal("connection is reported dead after data was read")
+	}
+	peer.Close()
+	if !waitDead(conn) {
+		t.Fatal("connection closed by peer is reported alive")
+	}
+}
+
+// waitDead reports whether connAlive reports conn as dead within a second,
+// giving data or FIN sent by peer time to arrive.
+func waitDead(conn net.Conn) bool {
+	deadline := time.Now().Add(time.Second)
+	for connAlive(conn) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// TestStaleIdleConn checks that idle connection closed by the backend, e.g.
+// by worker recycled after uWSGI --max-requests, is not reused.
+func TestStaleIdleConn(t *testing.T) {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "backend.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed := make(chan struct{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// serve a single request keeping connection open as if for
+			// reuse, then close it
+			if _, err := readVars(bufio.NewReader(conn)); err == nil {
+				io.WriteString(conn, okResponse(nil, nil))
+			}
+			conn.Close()
+			closed <- struct{}{}
+		}
+	}()
+	p := &Proxy{DialContext: Dial("unix", ln.Addr().String()), MaxIdleConns: 1}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i, w.Code, http.StatusOK)
+		}
+		<-closed
+	}
+	if st, want := p.PoolStats(), (PoolStats{Hits: 0, Misses: 3, Idle: 1}); st != want {
+		t.Fatalf("got %+v, want %+v", st, want)
+	}
+}
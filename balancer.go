@@ -0,0 +1,450 @@
+package uwsgi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BalanceStrategy defines how Balancer picks backend for a new connection.
+type BalanceStrategy int
+
+const (
+	// BalanceRoundRobin picks backends in turn.
+	BalanceRoundRobin BalanceStrategy = iota
+	// BalanceLeastConn picks backend with the fewest open connections.
+	BalanceLeastConn
+	// BalanceRandom picks backends at random.
+	BalanceRandom
+	// BalanceLeastBusy picks backend with the fewest busy workers and
+	// queued requests as reported by its uWSGI stats server, see
+	// Balancer.PollStats.
+	BalanceLeastBusy
+)
+
+// Balancer spreads backend connections across multiple uWSGI backends. Its
+// DialContext method is meant to be used as Proxy.DialContext:
+//
+//	b := uwsgi.NewBalancer(uwsgi.BalanceLeastConn,
+//		"/run/app1.socket", "/run/app2.socket", "10.0.0.2:3031")
+//	p := &uwsgi.Proxy{DialContext: b.DialContext}
+//
+// Backend that fails MaxFails times in a row is marked as failed and skipped
+// for FailTimeout; failed connection attempt is retried with the next
+// backend. If all backends are marked as failed, they're tried anyway.
+// Backends shutting down are skipped the same way if their stats are polled,
+// see PollStats. Backends can also be taken out of rotation manually with
+// SetDisabled. When
+// used with Proxy, failures to get response from the backend are counted
+// too, while successful responses reset the count.
+//
+// Balancer counts connections as open until they're closed, so with
+// connection reuse enabled (see Proxy.MaxIdleConns) idle connections count
+// too.
+type Balancer struct {
+	Strategy BalanceStrategy
+
+	// Key, if set, returns affinity key of the request: requests with the
+	// same non-empty key go to the same backend while it's available
+	// regardless of Strategy, e.g. chunks of resumable upload go to the
+	// backend keeping partial upload on local disk:
+	//
+	//	b.Key = func(r *http.Request) string { return r.Header.Get("Upload-Token") }
+	//
+	// Keys are mapped onto backends with rendezvous hashing, so adding or
+	// removing backend only moves keys mapped to it. It only applies to
+	// connections made by Proxy, which skips idle connections to other
+	// backends for such requests.
+	Key func(*http.Request) string
+
+	// MaxFails is the number of consecutive failures after which backend is
+	// marked as failed. If zero, 1 is used.
+	MaxFails int
+
+	// FailTimeout is how long backend marked as failed is skipped. If
+	// zero, 10 seconds is used.
+	FailTimeout time.Duration
+
+	// MaxConns, if positive, limits the number of open connections to each
+	// backend; backends at the limit are skipped. If all of them are,
+	// DialContext fails with error wrapping syscall.EAGAIN, which Proxy
+	// handles as DialOverloaded. Unlike Proxy.MaxConns, which is shared by
+	// all backends, it applies to each backend separately.
+	MaxConns int
+
+	// ErrorLog, if set, logs connections to removed backend that Remove
+	// closes once grace period expires.
+	ErrorLog *log.Logger
+
+	mu       sync.Mutex
+	backends []*balancedBackend
+	next     int // round-robin position
+}
+
+type balancedBackend struct {
+	addr        string
+	dial        DialFunc
+	conns       map[net.Conn]struct{} // open connections
+	dialing     int                   // connections being made
+	fails       int                   // consecutive failures
+	failedUntil time.Time
+	disabled    bool
+	draining    bool // set by PollStats
+
+	// Set by PollStats: busy workers plus listen queue length, or -1 if
+	// unknown, and connections made since the last poll.
+	load      int
+	sincePoll int
+}
+
+// NewBalancer returns Balancer with the given strategy and backend
+// addresses: paths to unix sockets (addresses containing "/") or host:port
+// pairs.
+func NewBalancer(strategy BalanceStrategy, addrs ...string) *Balancer {
+	b := &Balancer{Strategy: strategy}
+	for _, addr := range addrs {
+		b.Add(addr, nil)
+	}
+	return b
+}
+
+// Add adds backend with the given address, which is dialed with dial; if
+// dial is nil, connection is made with Dial to address on "unix" network if
+// it contains "/", or "tcp" network otherwise. Backends with the same
+// address are replaced.
+func (b *Balancer) Add(addr string, dial DialFunc) {
+	if dial == nil {
+		dial = Dial(addrNetwork(addr), addr)
+	}
+	be := &balancedBackend{addr: addr, dial: dial, conns: make(map[net.Conn]struct{}), load: -1}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, old := range b.backends {
+		if old.addr == addr {
+			b.backends[i] = be
+			return
+		}
+	}
+	b.backends = append(b.backends, be)
+}
+
+// Remove stops making new connections to the backend with the given address.
+// Connections to it that are still open once grace period expires are
+// forcibly closed, their number is logged with ErrorLog. It reports whether
+// backend was found.
+func (b *Balancer) Remove(addr string, grace time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, be := range b.backends {
+		if be.addr != addr {
+			continue
+		}
+		b.backends = append(b.backends[:i], b.backends[i+1:]...)
+		time.AfterFunc(grace, func() {
+			b.mu.Lock()
+			conns := make([]net.Conn, 0, len(be.conns))
+			for conn := range be.conns {
+				conns = append(conns, conn)
+			}
+			b.mu.Unlock()
+			for _, conn := range conns {
+				conn.Close()
+			}
+			if len(conns) != 0 && b.ErrorLog != nil {
+				b.ErrorLog.Printf("uwsgi backend %s removal: closed %d connections after %v grace period",
+					addr, len(conns), grace)
+			}
+		})
+		return true
+	}
+	return false
+}
+
+// SetDisabled disables or enables backend with the given address: no new
+// connections are made to disabled backend, existing ones are not affected.
+// It reports whether backend was found.
+func (b *Balancer) SetDisabled(addr string, disabled bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, be := range b.backends {
+		if be.addr == addr {
+			be.disabled = disabled
+			return true
+		}
+	}
+	return false
+}
+
+// DialContext connects to one of the backends picked according to Strategy,
+// trying others if it fails.
+func (b *Balancer) DialContext(ctx context.Context) (net.Conn, error) {
+	err := errors.New("no backends to dial")
+	var dialed bool
+	for _, be := range b.candidates(time.Now(), b.affinityKey(ctx)) {
+		if !b.reserve(be) {
+			continue
+		}
+		dialed = true
+		var conn net.Conn
+		if conn, err = be.dial(ctx); err == nil {
+			return b.track(be, conn), nil
+		}
+		b.mu.Lock()
+		be.dialing--
+		b.mu.Unlock()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		b.result(be, false)
+	}
+	if !dialed && b.MaxConns > 0 {
+		err = fmt.Errorf("all backends have %d connections open: %w", b.MaxConns, syscall.EAGAIN)
+	}
+	return nil, err
+}
+
+// reserve reports whether connection to be can be made within MaxConns,
+// counting it as being made.
+func (b *Balancer) reserve(be *balancedBackend) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.MaxConns > 0 && len(be.conns)+be.dialing >= b.MaxConns {
+		return false
+	}
+	be.dialing++
+	return true
+}
+
+// candidates returns backends in order they should be tried in, for
+// request with the given affinity key, if any.
+func (b *Balancer) candidates(now time.Time, key string) []*balancedBackend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out, enabled []*balancedBackend
+	for _, be := range b.backends {
+		if be.disabled {
+			continue
+		}
+		enabled = append(enabled, be)
+		if !now.Before(be.failedUntil) && !be.draining {
+			out = append(out, be)
+		}
+	}
+	if len(out) == 0 {
+		out = enabled
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	if key != "" {
+		sort.Slice(out, func(i, j int) bool {
+			return affinityWeight(key, out[i].addr) > affinityWeight(key, out[j].addr)
+		})
+		return out
+	}
+	switch b.Strategy {
+	case BalanceRandom:
+		rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	case BalanceLeastConn:
+		b.rotate(out) // spread ties
+		sort.SliceStable(out, func(i, j int) bool { return len(out[i].conns) < len(out[j].conns) })
+	case BalanceLeastBusy:
+		b.rotate(out)
+		sort.SliceStable(out, func(i, j int) bool { return out[i].lessBusy(out[j]) })
+	default:
+		b.rotate(out)
+	}
+	return out
+}
+
+// rotate rotates backends list to the next round-robin position, it must be
+// called with b.mu held.
+func (b *Balancer) rotate(list []*balancedBackend) {
+	k := b.next % len(list)
+	b.next++
+	tmp := append([]*balancedBackend(nil), list[:k]...)
+	copy(list, list[k:])
+	copy(list[len(list)-k:], tmp)
+}
+
+// result records result of exchange with the backend, marking it as failed
+// after MaxFails consecutive failures.
+func (b *Balancer) result(be *balancedBackend, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		be.fails = 0
+		return
+	}
+	be.fails++
+	if be.fails < max(b.MaxFails, 1) {
+		return
+	}
+	timeout := b.FailTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	be.fails = 0
+	be.failedUntil = time.Now().Add(timeout)
+}
+
+// BackendStatus returns health of the backends.
+func (b *Balancer) BackendStatus() []BackendStatus {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]BackendStatus, 0, len(b.backends))
+	for _, be := range b.backends {
+		st := BackendStatus{Addr: be.addr, Healthy: !now.Before(be.failedUntil),
+			Fails: be.fails, Conns: len(be.conns), Disabled: be.disabled, Draining: be.draining}
+		if !st.Healthy {
+			st.RetryAt = be.failedUntil
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// track registers conn as open to be, returning wrapper that unregisters it
+// on close.
+func (b *Balancer) track(be *balancedBackend, conn net.Conn) net.Conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tc := &trackedConn{Conn: conn, dial: be.dial, report: func(ok bool) { b.result(be, ok) }}
+	tc.affine = func(ctx context.Context) bool {
+		key := b.affinityKey(ctx)
+		if key == "" {
+			return true
+		}
+		list := b.candidates(time.Now(), key)
+		return len(list) != 0 && list[0] == be
+	}
+	tc.onClose = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(be.conns, tc)
+	}
+	be.conns[tc] = struct{}{}
+	be.dialing--
+	be.sincePoll++
+	return tc
+}
+
+// trackedConn is a net.Conn calling onClose once it's closed. Proxy reports
+// results of exchanges over it with report, checks with affine whether it's
+// made to the backend Balancer picks for request in ctx, and connects to the
+// same backend with dial.
+type trackedConn struct {
+	net.Conn
+	dial    DialFunc
+	once    sync.Once
+	onClose func()
+	report  func(ok bool)
+	affine  func(ctx context.Context) bool
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection.
+func (c *trackedConn) NetConn() net.Conn { return c.Conn }
+
+// asTracked returns trackedConn conn wraps, if any.
+func asTracked(conn net.Conn) *trackedConn {
+	for conn != nil {
+		if tc, ok := conn.(*trackedConn); ok {
+			return tc
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = u.NetConn()
+	}
+	return nil
+}
+
+// affinityKey returns affinity key of the request Proxy dials backend for
+// with ctx, see Key.
+func (b *Balancer) affinityKey(ctx context.Context) string {
+	if b.Key == nil {
+		return ""
+	}
+	if r := ctxRequest(ctx); r != nil {
+		return b.Key(r)
+	}
+	return ""
+}
+
+// affinityWeight returns rendezvous hashing weight of backend with the given
+// address for affinity key.
+func affinityWeight(key, addr string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	h.Write([]byte{0})
+	io.WriteString(h, addr)
+	return h.Sum64()
+}
+
+// addrNetwork returns network of the backend address: "unix" for addresses
+// containing "/", "tcp" otherwise.
+func addrNetwork(addr string) string {
+	if strings.Contains(addr, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// HealthCheck pings each backend (see Ping) every interval until ctx is
+// canceled, calling fn, if not nil, with results. Failed pings count towards
+// MaxFails, and successful ones bring backends marked as failed back into
+// rotation right away. Backends are pinged concurrently, so fn may be called
+// concurrently too.
+func (b *Balancer) HealthCheck(ctx context.Context, interval time.Duration, fn func(addr string, rtt time.Duration, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		b.mu.Lock()
+		backends := append([]*balancedBackend(nil), b.backends...)
+		b.mu.Unlock()
+		var wg sync.WaitGroup
+		for _, be := range backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rtt, err := Ping(ctx, be.dial)
+				if ctx.Err() != nil {
+					return
+				}
+				b.result(be, err == nil)
+				if err == nil {
+					b.mu.Lock()
+					be.failedUntil = time.Time{}
+					b.mu.Unlock()
+				}
+				if fn != nil {
+					fn(be.addr, rtt, err)
+				}
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
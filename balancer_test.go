@@ -0,0 +1,346 @@
+package uwsgi
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeastBusy(t *testing.T) {
+	// statsDial returns dialer of fake uWSGI stats server writing out.
+	statsDial := func(out string) DialFunc {
+		return func(ctx context.Context) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				io.WriteString(server, out)
+			}()
+			return client, nil
+		}
+	}
+	stats := map[string]DialFunc{
+		"a": statsDial(`{"listen_queue": 1, "workers": [{"status": "busy"}, {"status": "idle"}, {"status": "busy"}]}`),
+		"b": statsDial("HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n\r\n" +
+			`{"listen_queue": 0, "workers": [{"status": "busy"}, {"status": "idle"}]}`),
+	}
+	backends := map[string]*testBackend{"a": {}, "b": {}, "c": {}}
+	b := &Balancer{Strategy: BalanceLeastBusy}
+	for _, addr := range []string{"a", "b", "c"} {
+		b.Add(addr, backends[addr].dial)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	loads := make(map[string]int)
+	b.PollStats(ctx, time.Second, func(addr string) DialFunc { return stats[addr] },
+		func(addr string, load int, err error) {
+			if err != nil {
+				t.Errorf("%s: %v", addr, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if loads[addr] = load; len(loads) == len(stats) {
+				cancel()
+			}
+		})
+	if loads["a"] != 3 || loads["b"] != 1 {
+		t.Fatalf("got loads %v, want a:3 b:1", loads)
+	}
+	var order []string
+	for _, be := range b.candidates(time.Now(), "") {
+		order = append(order, be.addr)
+	}
+	if got, want := order, []string{"b", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got order %q, want %q", got, want)
+	}
+	// connections made since the poll count towards load: b has 1 busy
+	// worker, so it takes 2 connections before a with 3 gets any
+	for range 2 {
+		conn, err := b.DialContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	if got := backends["b"].dials.Load(); got != 2 {
+		t.Fatalf("backend b got %d dials, want 2", got)
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	addrs := []string{"a", "b", "c"}
+	backends := make(map[string]*testBackend)
+	b := &Balancer{Key: func(r *http.Request) string { return r.Header.Get("Upload-Token") }}
+	for _, addr := range addrs {
+		backends[addr] = &testBackend{handle: okResponse, keepAlive: true}
+		b.Add(addr, backends[addr].dial)
+	}
+	p := &Proxy{DialContext: b.DialContext, MaxIdleConns: 4}
+	send := func(token string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPut, "/upload", nil)
+		if token != "" {
+			r.Header.Set("Upload-Token", token)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	// landed returns backends that got requests with token
+	landed := func(token string) []string {
+		var out []string
+		for _, addr := range addrs {
+			be := backends[addr]
+			be.mu.Lock()
+			for _, vars := range be.reqs {
+				if vars["HTTP_UPLOAD_TOKEN"] == token {
+					out = append(out, addr)
+					break
+				}
+			}
+			be.mu.Unlock()
+		}
+		return out
+	}
+	tokens := []string{"t1", "t2", "t3", "t4", "t5", "t6"}
+	for range 3 {
+		for _, token := range tokens {
+			send(token)
+			send("") // leaves idle connection to the next backend in turn
+		}
+	}
+	for _, token := range tokens {
+		if got := landed(token); len(got) != 1 {
+			t.Fatalf("requests with token %q went to backends %q, want one", token, got)
+		}
+	}
+	// with its backend disabled, token moves to another one
+	addr := landed("t1")[0]
+	b.SetDisabled(addr, true)
+	send("t1")
+	send("t1")
+	if got := landed("t1"); len(got) != 2 {
+		t.Fatalf("requests with token %q went to backends %q, want 2", "t1", got)
+	}
+}
+
+func TestBalancerMaxConns(t *testing.T) {
+	a, c := &testBackend{}, &testBackend{}
+	b := &Balancer{Strategy: BalanceRoundRobin, MaxConns: 1}
+	b.Add("a", a.dial)
+	b.Add("c", c.dial)
+	var conns []net.Conn
+	for range 2 {
+		conn, err := b.DialContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	if a.dials.Load() != 1 || c.dials.Load() != 1 {
+		t.Fatalf("got dials a:%d c:%d, want one each", a.dials.Load(), c.dials.Load())
+	}
+	_, err := b.DialContext(context.Background())
+	if kind := ClassifyDialError(err); kind != DialOverloaded {
+		t.Fatalf("got error %v (%v), want %v", err, kind, DialOverloaded)
+	}
+	conns[0].Close()
+	conn, err := b.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("dial after close: %v", err)
+	}
+	conn.Close()
+	conns[1].Close()
+}
+
+func TestDisconnectSignal(t *testing.T) {
+	started := make(chan string, 1)
+	signaled := make(chan string, 1)
+	release := make(chan struct{})
+	defer close(release)
+	b := &Balancer{}
+	for _, addr := range []string{"a", "c"} {
+		be := &testBackend{handle: func(vars map[string]string, body []byte) string {
+			if len(vars) == 0 { // signal packet
+				signaled <- addr
+				return ""
+			}
+			started <- addr
+			<-release
+			return okResponse(vars, body)
+		}}
+		b.Add(addr, be.dial)
+	}
+	p := &Proxy{DialContext: b.DialContext, DisconnectSignal: 30}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		p.ServeHTTPResult(httptest.NewRecorder(), r)
+	}()
+	addr := <-started
+	cancel()
+	select {
+	case got := <-signaled:
+		if got != addr {
+			t.Fatalf("signal sent to backend %q, request was served by %q", got, addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no signal sent")
+	}
+	<-done
+}
+
+func TestBalancerRemove(t *testing.T) {
+	logged := make(chan string, 1)
+	b := &Balancer{ErrorLog: log.New(logWriter(func(s string) { logged <- s }), "", 0)}
+	b.Add("a", new(testBackend).dial)
+	conn, err := b.DialContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Remove("a", 10*time.Millisecond) {
+		t.Fatal("backend not found")
+	}
+	if b.Remove("a", 0) {
+		t.Fatal("removed backend found again")
+	}
+	if _, err := b.DialContext(context.Background()); err == nil {
+		t.Fatal("dialed removed backend")
+	}
+	select {
+	case s := <-logged:
+		if want := "uwsgi backend a removal: closed 1 connections after 10ms grace period\n"; s != want {
+			t.Fatalf("got log %q, want %q", s, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no log after grace period")
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatal("connection to removed backend is not closed")
+	}
+}
+
+type logWriter func(string)
+
+func (w logWriter) Write(b []byte) (int, error) { w(string(b)); return len(b), nil }
+
+func TestReadLoad(t *testing.T) {
+	for _, tc := range []struct {
+		stats    string
+		load     int
+		draining bool
+	}{
+		{stats: `{"listen_queue": 2, "workers": [{"status": "busy", "accepting": 1}, {"status": "idle", "accepting": 1}]}`, load: 3},
+		{stats: `{"listen_queue": 0, "workers": [{"status": "busy"}, {"status": "idle"}]}`, load: 1},
+		{stats: `{"listen_queue": 0, "workers": [{"status": "busy", "accepting": 0}, {"status": "idle", "accepting": 1}]}`, load: 1},
+		{stats: `{"listen_queue": 0, "workers": [{"status": "busy", "accepting": 0}, {"status": "idle", "accepting": 0}]}`, load: 1, draining: true},
+		{stats: `{"listen_queue": 0, "workers": [{"status": "pause"}, {"status": "cheap"}]}`, draining: true},
+		{stats: `{"listen_queue": 0, "workers": []}`},
+	} {
+		dial := func(ctx context.Context) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				io.WriteString(server, tc.stats)
+			}()
+			return client, nil
+		}
+		load, draining, err := readLoad(context.Background(), dial, time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.stats, err)
+		}
+		if load != tc.load || draining != tc.draining {
+			t.Errorf("%s: got load %d, draining %v, want %d, %v", tc.stats, load, draining, tc.load, tc.draining)
+		}
+	}
+}
+
+func TestDraining(t *testing.T) {
+	stats := map[string]string{
+		"a": `{"workers": [{"status": "idle", "accepting": 0}]}`,
+		"b": `{"workers": [{"status": "idle", "accepting": 1}]}`,
+	}
+	statsDial := func(addr string) DialFunc {
+		return func(ctx context.Context) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				io.WriteString(server, stats[addr])
+			}()
+			return client, nil
+		}
+	}
+	backends := map[string]*testBackend{"a": {}, "b": {}}
+	b := &Balancer{Strategy: BalanceLeastConn}
+	b.Add("a", backends["a"].dial)
+	open, err := b.DialContext(context.Background()) // made before a is draining
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	b.Add("b", backends["b"].dial)
+	poll := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		var n atomic.Int32
+		b.PollStats(ctx, time.Second, statsDial, func(string, int, error) {
+			if n.Add(1) == int32(len(stats)) {
+				cancel()
+			}
+		})
+	}
+	poll()
+	for range 3 {
+		conn, err := b.DialContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	if got := backends["a"].dials.Load(); got != 1 {
+		t.Fatalf("draining backend got %d dials, want only 1 made before draining", got)
+	}
+	var draining []string
+	for _, st := range b.BackendStatus() {
+		if st.Draining {
+			draining = append(draining, st.Addr)
+		}
+		if st.Addr == "a" && st.Conns != 1 {
+			t.Fatalf("draining backend has %d connections open, want 1", st.Conns)
+		}
+	}
+	if !reflect.DeepEqual(draining, []string{"a"}) {
+		t.Fatalf("got draining backends %q, want [a]", draining)
+	}
+	// all backends draining: tried anyway
+	stats["b"] = stats["a"]
+	poll()
+	conn, err := b.DialContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// a is back, and has the fewest connections
+	stats["a"] = `{"workers": [{"status": "idle"}]}`
+	poll()
+	before := backends["a"].dials.Load()
+	conn, err = b.DialContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := backends["a"].dials.Load() - before; got != 1 {
+		t.Fatal("backend got no dials after it stopped draining")
+	}
+}
@@ -0,0 +1,109 @@
+package uwsgi
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BotThrottle limits the rate of requests from bots and crawlers, so that
+// aggressive crawls can't exhaust backend capacity, while still serving
+// them. Requests over the rate are queued for up to MaxWait; requests that
+// would have to wait longer get 429 Too Many Requests reply with
+// Retry-After header. Other requests are not affected.
+//
+// Use BotThrottle.Handler to wrap handler being protected.
+type BotThrottle struct {
+	// Match reports whether request comes from a bot. If nil, requests
+	// classified as DeviceBot by ClassifyDevice are matched.
+	Match func(*http.Request) bool
+
+	// Rate is the max number of matching requests per second, shared by
+	// all bots. If not positive, requests are not throttled.
+	Rate float64
+
+	// Burst is the number of matching requests allowed to go over Rate at
+	// once. If zero, Rate rounded up is used.
+	Burst int
+
+	// MaxWait is how long matching request can be queued waiting for its
+	// turn. If zero, requests over the rate are rejected right away.
+	MaxWait time.Duration
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Handler returns handler that passes requests to h, throttling those from
+// bots.
+func (t *BotThrottle) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t.Rate <= 0 || !t.match(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		wait, ok := t.reserve(time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-r.Context().Done():
+				t.release()
+				return
+			case <-timer.C:
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (t *BotThrottle) match(r *http.Request) bool {
+	if t.Match != nil {
+		return t.Match(r)
+	}
+	return ClassifyDevice(r.UserAgent()) == DeviceBot
+}
+
+// reserve takes a token from the bucket, returning how long request has to
+// wait for it. If wait exceeds MaxWait, it reports false and the token is
+// not taken; returned duration is then the time until one is available.
+func (t *BotThrottle) reserve(now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	burst := float64(t.Burst)
+	if t.Burst <= 0 {
+		burst = math.Ceil(t.Rate)
+	}
+	if t.last.IsZero() {
+		t.tokens = burst
+	} else {
+		t.tokens = math.Min(burst, t.tokens+now.Sub(t.last).Seconds()*t.Rate)
+	}
+	t.last = now
+	tokens := t.tokens - 1
+	var wait time.Duration
+	if tokens < 0 {
+		wait = time.Duration(-tokens / t.Rate * float64(time.Second))
+	}
+	if wait > t.MaxWait {
+		return wait - t.MaxWait, false
+	}
+	t.tokens = tokens
+	return wait, true
+}
+
+// release returns token taken by reserve for request that was canceled while
+// waiting.
+func (t *BotThrottle) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens++
+}
@@ -0,0 +1,83 @@
+package uwsgi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBotThrottleReserve(t *testing.T) {
+	start := time.Now()
+	th := &BotThrottle{Rate: 2, Burst: 2, MaxWait: time.Second}
+	for i, tc := range []struct {
+		at   time.Duration // since start
+		wait time.Duration
+		ok   bool
+	}{
+		{at: 0, wait: 0, ok: true}, // burst
+		{at: 0, wait: 0, ok: true},
+		{at: 0, wait: 500 * time.Millisecond, ok: true}, // queued
+		{at: 0, wait: time.Second, ok: true},
+		{at: 0, wait: 500 * time.Millisecond, ok: false}, // would wait 1.5s
+		{at: 2 * time.Second, wait: 0, ok: true},         // refilled 4 tokens, capped by burst
+		{at: 2 * time.Second, wait: 0, ok: true},
+		{at: 2 * time.Second, wait: 500 * time.Millisecond, ok: true},
+		{at: 2250 * time.Millisecond, wait: 750 * time.Millisecond, ok: true},
+	} {
+		wait, ok := th.reserve(start.Add(tc.at))
+		if wait != tc.wait || ok != tc.ok {
+			t.Fatalf("request %d at %v: got %v, %v, want %v, %v", i, tc.at, wait, ok, tc.wait, tc.ok)
+		}
+	}
+}
+
+func TestBotThrottle(t *testing.T) {
+	var calls int
+	th := &BotThrottle{Rate: 1, Burst: 1}
+	h := th.Handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { calls++ }))
+	do := func(ua string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := do("Googlebot/2.1"); w.Code != http.StatusOK {
+		t.Fatalf("first bot request: got status %d", w.Code)
+	}
+	w := do("Googlebot/2.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("second bot request: got status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	for i := 0; i < 3; i++ {
+		if w := do("Mozilla/5.0 (Windows NT 10.0; Win64; x64)"); w.Code != http.StatusOK {
+			t.Fatalf("browser request: got status %d", w.Code)
+		}
+	}
+	if calls != 4 {
+		t.Fatalf("handler called %d times, want 4", calls)
+	}
+}
+
+// TestBotThrottleCancel checks that request canceled while queued gives its
+// token back.
+func TestBotThrottleCancel(t *testing.T) {
+	th := &BotThrottle{Rate: 1, Burst: 1, MaxWait: time.Minute}
+	h := th.Handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("canceled request passed")
+	}))
+	if _, ok := th.reserve(time.Now()); !ok {
+		t.Fatal("first request not allowed")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	r.Header.Set("User-Agent", "Googlebot/2.1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	// without the token given back, the next request would wait for 2s
+	if wait, ok := th.reserve(time.Now()); !ok || wait > time.Second {
+		t.Fatalf("request after canceled one: got wait %v, %v, want at most 1s", wait, ok)
+	}
+}
@@ -0,0 +1,333 @@
+package uwsgi
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// ForwardedStrategy selects client address from the chain of addresses found
+// in X-Forwarded-For or Forwarded headers, ordered from the client to the
+// nearest proxy. Entries that are not valid IP addresses are passed as zero
+// netip.Addr values. ForwardedStrategy returns zero netip.Addr if chain has
+// no suitable address.
+type ForwardedStrategy func(chain []netip.Addr) netip.Addr
+
+// ForwardedFirst returns ForwardedStrategy that selects the leftmost address,
+// i.e. the one added by the client or the first proxy. It's only reliable if
+// the first proxy discards client-provided values, since clients can put
+// anything there.
+func ForwardedFirst() ForwardedStrategy {
+	return func(chain []netip.Addr) netip.Addr {
+		if len(chain) == 0 {
+			return netip.Addr{}
+		}
+		return chain[0]
+	}
+}
+
+// ForwardedLast returns ForwardedStrategy that selects the rightmost address,
+// i.e. the one added by the nearest proxy. It fits setups with a single proxy
+// in front of Proxy.
+func ForwardedLast() ForwardedStrategy {
+	return func(chain []netip.Addr) netip.Addr {
+		if len(chain) == 0 {
+			return netip.Addr{}
+		}
+		return chain[len(chain)-1]
+	}
+}
+
+// ForwardedRightmostUntrusted returns ForwardedStrategy that walks the chain
+// from right to left skipping addresses of trusted proxies, and selects the
+// first address that is not trusted. This is the address client connected to
+// trusted infrastructure from, which clients cannot spoof.
+func ForwardedRightmostUntrusted(trusted ...netip.Prefix) ForwardedStrategy {
+	return func(chain []netip.Addr) netip.Addr {
+		for i := len(chain) - 1; i >= 0; i-- {
+			if !chain[i].IsValid() {
+				break
+			}
+			if prefixesContain(trusted, chain[i]) {
+				continue
+			}
+			return chain[i]
+		}
+		return netip.Addr{}
+	}
+}
+
+// TrustMode defines when Proxy honors client address headers, see
+// Proxy.ForwardedTrust.
+type TrustMode int
+
+const (
+	// TrustIgnore makes Proxy ignore client address headers, always
+	// using the peer address.
+	TrustIgnore TrustMode = iota + 1
+
+	// TrustFirstUntrusted makes Proxy honor client address headers only
+	// if peer address is in TrustedProxies, taking the rightmost address
+	// of the forwarded chain that is not, see ForwardedRightmostUntrusted.
+	TrustFirstUntrusted
+
+	// TrustAlways makes Proxy honor client address headers regardless of
+	// the peer, which is only safe if Proxy is not directly reachable by
+	// clients.
+	TrustAlways
+)
+
+func (p *Proxy) trustMode() TrustMode {
+	if p.ForwardedTrust != 0 {
+		return p.ForwardedTrust
+	}
+	if len(p.TrustedProxies) != 0 {
+		return TrustFirstUntrusted
+	}
+	return TrustAlways
+}
+
+// trustHeaders reports whether client address headers of the request can
+// be honored.
+func (p *Proxy) trustHeaders(r *http.Request) bool {
+	switch p.trustMode() {
+	case TrustIgnore:
+		return false
+	case TrustAlways:
+		return true
+	}
+	peer, ok := parseAddr(r.RemoteAddr)
+	return ok && prefixesContain(p.TrustedProxies, peer)
+}
+
+// rewritesForwarded reports whether Proxy passes its own X-Forwarded-For and
+// other forwarding headers to the backend, see setForwarded.
+func (p *Proxy) rewritesForwarded() bool {
+	return !p.Passthrough && (p.ForwardedHeaders || p.trustMode() != TrustAlways)
+}
+
+// setForwarded updates h, a copy of r headers, so that X-Forwarded-For chain
+// includes peer address; with ForwardedHeaders set, it also sets
+// X-Forwarded-Proto, X-Forwarded-Host, and appends element to Forwarded
+// chain. Values from untrusted peers are replaced, see ForwardedTrust.
+func (p *Proxy) setForwarded(h http.Header, r *http.Request) {
+	if chain := p.forwardedChain(r); chain != "" {
+		h.Set("X-Forwarded-For", chain)
+	} else {
+		h.Del("X-Forwarded-For")
+	}
+	if !p.ForwardedHeaders {
+		return
+	}
+	trusted := p.trustHeaders(r)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if !trusted || h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", scheme)
+	}
+	if !trusted || h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+	node := "unknown"
+	if a, ok := parseAddr(r.RemoteAddr); ok {
+		node = a.String()
+		if a.Is6() {
+			node = `"[` + node + `]"`
+		}
+	}
+	elem := "for=" + node + ";host=" + forwardedToken(r.Host) + ";proto=" + scheme
+	if prev := h.Values("Forwarded"); trusted && len(prev) != 0 {
+		elem = strings.Join(prev, ", ") + ", " + elem
+	}
+	h.Set("Forwarded", elem)
+}
+
+// forwardedToken returns s as a Forwarded header parameter value, quoting it
+// unless it's a token.
+func forwardedToken(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool { return !httpguts.IsTokenRune(r) }) == -1 {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+// forwardedChain returns X-Forwarded-For value to pass to the backend: the
+// incoming chain with peer address appended if headers are trusted, or peer
+// address alone otherwise.
+func (p *Proxy) forwardedChain(r *http.Request) string {
+	var chain string
+	if p.trustHeaders(r) {
+		chain = strings.Join(r.Header.Values("X-Forwarded-For"), ", ")
+	}
+	peer, ok := parseAddr(r.RemoteAddr)
+	switch {
+	case !ok:
+		return chain
+	case chain == "":
+		return peer.String()
+	}
+	return chain + ", " + peer.String()
+}
+
+func prefixesContain(prefixes []netip.Prefix, a netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns client address as passed to the backend in REMOTE_ADDR
+// variable: taken from the first of ClientIPHeaders with an address selected
+// by ForwardedStrategy, or from the connected peer address. Logging and rate
+// limiting middleware may use it to identify clients consistently with the
+// backend. It returns zero netip.Addr if address is unknown.
+func (p *Proxy) ClientIP(r *http.Request) netip.Addr {
+	if a, ok := p.headersAddr(r); ok {
+		return a
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if a, ok := parseAddr(host); ok {
+			return a
+		}
+	}
+	return netip.Addr{}
+}
+
+// remoteAddr returns client address and port for REMOTE_ADDR and REMOTE_PORT
+// variables; either can be empty if unknown. Address is taken from the first
+// of p.ClientIPHeaders holding a valid address, otherwise from the connected
+// peer address.
+func (p *Proxy) remoteAddr(r *http.Request) (addr, port string) {
+	if peer, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		addr, port = normAddr(peer.Addr()).String(), strconv.Itoa(int(peer.Port()))
+	} else if host, peerPort, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		addr, port = host, peerPort
+		if a, ok := parseAddr(host); ok {
+			addr = a.String()
+		}
+	}
+	if a, ok := p.headersAddr(r); ok {
+		return a.String(), port
+	}
+	return addr, port
+}
+
+// localAddr returns address and port of the listener that accepted request,
+// either can be empty if unknown.
+func localAddr(r *http.Request) (addr, port string) {
+	a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return "", ""
+	}
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return "", ""
+	}
+	if a, ok := parseAddr(host); ok {
+		host = a.String()
+	}
+	return host, port
+}
+
+// headersAddr returns client address from the first of p.ClientIPHeaders
+// holding a valid address, if they can be trusted.
+func (p *Proxy) headersAddr(r *http.Request) (netip.Addr, bool) {
+	if !p.trustHeaders(r) {
+		return netip.Addr{}, false
+	}
+	headers := p.ClientIPHeaders
+	if headers == nil {
+		headers = []string{"X-Forwarded-For"}
+	}
+	strategy := p.ForwardedStrategy
+	if p.trustMode() == TrustFirstUntrusted {
+		strategy = ForwardedRightmostUntrusted(p.TrustedProxies...)
+	} else if strategy == nil {
+		strategy = ForwardedFirst()
+	}
+	for _, name := range headers {
+		if a, ok := headerAddr(r.Header, name, strategy); ok {
+			return a, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// headerAddr returns client address from the named header, using strategy
+// for headers holding a chain of addresses.
+func headerAddr(h http.Header, name string, strategy ForwardedStrategy) (netip.Addr, bool) {
+	name = http.CanonicalHeaderKey(name)
+	var chain []string
+	switch name {
+	case "X-Forwarded-For":
+		for _, v := range h.Values(name) {
+			chain = append(chain, strings.Split(v, ",")...)
+		}
+	case "Forwarded":
+		for _, v := range h.Values(name) {
+			chain = append(chain, forwardedFor(v)...)
+		}
+	default:
+		return parseAddr(h.Get(name))
+	}
+	if len(chain) == 0 {
+		return netip.Addr{}, false
+	}
+	addrs := make([]netip.Addr, len(chain))
+	for i, s := range chain {
+		addrs[i], _ = parseAddr(s)
+	}
+	a := strategy(addrs)
+	return normAddr(a), a.IsValid()
+}
+
+// forwardedFor returns values of the "for" parameter of each element of
+// Forwarded header value, see RFC 7239. Elements without "for" parameter
+// have empty value.
+func forwardedFor(s string) []string {
+	var out []string
+	for _, elem := range strings.Split(s, ",") {
+		var value string
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(k, "for") {
+				value = strings.Trim(v, `"`)
+				break
+			}
+		}
+		out = append(out, value)
+	}
+	return out
+}
+
+// parseAddr parses IP address in one of the forms used by X-Forwarded-For and
+// similar headers: "192.0.2.1", "192.0.2.1:1234", "2001:db8::1",
+// "[2001:db8::1]", "[2001:db8::1]:1234". Port is ignored, zone is stripped,
+// IPv4-mapped IPv6 addresses are converted to IPv4.
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if a, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err == nil {
+		return normAddr(a), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return normAddr(ap.Addr()), true
+	}
+	// netip.ParseAddrPort does not accept zones
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		if a, err := netip.ParseAddr(host); err == nil {
+			return normAddr(a), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// normAddr strips zone and converts IPv4-mapped IPv6 address to IPv4.
+func normAddr(a netip.Addr) netip.Addr { return a.WithZone("").Unmap() }
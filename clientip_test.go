@@ -0,0 +1,229 @@
+package uwsgi
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string // empty if invalid
+	}{
+		{in: "192.0.2.1", want: "192.0.2.1"},
+		{in: " 192.0.2.1 ", want: "192.0.2.1"},
+		{in: "192.0.2.1:1234", want: "192.0.2.1"},
+		{in: "2001:db8::1", want: "2001:db8::1"},
+		{in: "[2001:db8::1]", want: "2001:db8::1"},
+		{in: "[2001:db8::1]:1234", want: "2001:db8::1"},
+		{in: "fe80::1%eth0", want: "fe80::1"},
+		{in: "[fe80::1%eth0]", want: "fe80::1"},
+		{in: "[fe80::1%eth0]:1234", want: "fe80::1"},
+		{in: "::ffff:192.0.2.1", want: "192.0.2.1"},
+		{in: "[::ffff:192.0.2.1]:1234", want: "192.0.2.1"},
+		{in: ""},
+		{in: "unknown"},
+		{in: "_hidden"},
+		{in: "example.com:80"},
+		{in: "192.0.2.1:port", want: "192.0.2.1"}, // port is ignored
+	} {
+		a, ok := parseAddr(tc.in)
+		if ok != (tc.want != "") {
+			t.Errorf("parseAddr(%q): got ok=%v", tc.in, ok)
+			continue
+		}
+		if ok && a.String() != tc.want {
+			t.Errorf("parseAddr(%q): got %v, want %s", tc.in, a, tc.want)
+		}
+	}
+}
+
+func TestNormAddr(t *testing.T) {
+	for in, want := range map[string]string{
+		"192.0.2.1":        "192.0.2.1",
+		"::ffff:192.0.2.1": "192.0.2.1",
+		"fe80::1%eth0":     "fe80::1",
+		"2001:db8::1":      "2001:db8::1",
+	} {
+		if got := normAddr(netip.MustParseAddr(in)); got.String() != want {
+			t.Errorf("normAddr(%s): got %v, want %s", in, got, want)
+		}
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	for _, tc := range []struct {
+		remote     string
+		addr, port string
+	}{
+		{remote: "192.0.2.1:1234", addr: "192.0.2.1", port: "1234"},
+		{remote: "[2001:db8::1]:1234", addr: "2001:db8::1", port: "1234"},
+		{remote: "[::ffff:192.0.2.1]:1234", addr: "192.0.2.1", port: "1234"},
+		{remote: "[fe80::1%eth0]:1234", addr: "fe80::1", port: "1234"},
+		{remote: "localhost:1234", addr: "localhost", port: "1234"},
+		{remote: "@"},
+		{remote: ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		p := &Proxy{ForwardedTrust: TrustIgnore}
+		if addr, port := p.remoteAddr(r); addr != tc.addr || port != tc.port {
+			t.Errorf("remoteAddr for %q: got %q, %q, want %q, %q", tc.remote, addr, port, tc.addr, tc.port)
+		}
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	for in, want := range map[string][]string{
+		"for=192.0.2.1":                            {"192.0.2.1"},
+		`for="[2001:db8::1]:4711";proto=https`:     {"[2001:db8::1]:4711"},
+		"For=192.0.2.1, by=10.0.0.1, for=10.0.0.2": {"192.0.2.1", "", "10.0.0.2"},
+		"proto=http;for=_hidden;host=example.com":  {"_hidden"},
+		"for=unknown, for=\"192.0.2.1\"":           {"unknown", "192.0.2.1"},
+	} {
+		if got := forwardedFor(in); !reflect.DeepEqual(got, want) {
+			t.Errorf("forwardedFor(%q): got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	for _, tc := range []struct {
+		name    string
+		proxy   *Proxy
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:    "untrusted peer spoofing XFF",
+			proxy:   &Proxy{TrustedProxies: trusted},
+			remote:  "203.0.113.7:1234",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1"},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "trusted chain",
+			proxy:   &Proxy{TrustedProxies: trusted},
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1, 10.0.0.3, 10.0.0.2"},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "client spoofing leftmost entry behind trusted chain",
+			proxy:   &Proxy{TrustedProxies: trusted},
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 192.0.2.1, 10.0.0.2"},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "garbage entry stops rightmost-untrusted walk",
+			proxy:   &Proxy{TrustedProxies: trusted},
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1, garbage, 10.0.0.2"},
+			want:    "10.0.0.1",
+		},
+		{
+			name:    "all entries trusted",
+			proxy:   &Proxy{TrustedProxies: trusted},
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			want:    "10.0.0.1",
+		},
+		{
+			name:   "quoted IPv6 in Forwarded",
+			proxy:  &Proxy{TrustedProxies: trusted, ClientIPHeaders: []string{"Forwarded"}},
+			remote: "10.0.0.1:1234",
+			headers: map[string]string{
+				"Forwarded": `for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`,
+			},
+			want: "2001:db8::1",
+		},
+		{
+			name:   "Forwarded element without for stops the walk",
+			proxy:  &Proxy{TrustedProxies: trusted, ClientIPHeaders: []string{"Forwarded"}},
+			remote: "10.0.0.1:1234",
+			headers: map[string]string{
+				"Forwarded": "for=192.0.2.1, by=10.0.0.5, for=10.0.0.2",
+			},
+			want: "10.0.0.1",
+		},
+		{
+			name:  "header order",
+			proxy: &Proxy{TrustedProxies: trusted, ClientIPHeaders: []string{"X-Real-Ip", "X-Forwarded-For"}},
+			headers: map[string]string{
+				"X-Real-Ip":       "not an address",
+				"X-Forwarded-For": "192.0.2.1",
+			},
+			remote: "10.0.0.1:1234",
+			want:   "192.0.2.1",
+		},
+		{
+			name:    "TrustIgnore",
+			proxy:   &Proxy{ForwardedTrust: TrustIgnore},
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "192.0.2.1"},
+			want:    "10.0.0.1",
+		},
+		{
+			name:    "TrustAlways takes leftmost entry",
+			proxy:   &Proxy{},
+			remote:  "203.0.113.7:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 192.0.2.1"},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "TrustAlways with ForwardedLast",
+			proxy:   &Proxy{ForwardedStrategy: ForwardedLast()},
+			remote:  "203.0.113.7:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, [::ffff:192.0.2.1]"},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "TrustFirstUntrusted overrides ForwardedStrategy",
+			proxy:   &Proxy{TrustedProxies: trusted, ForwardedStrategy: ForwardedFirst()},
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 192.0.2.1"},
+			want:    "192.0.2.1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			if got := tc.proxy.ClientIP(r); got.String() != tc.want {
+				t.Fatalf("ClientIP: got %v, want %s", got, tc.want)
+			}
+			if got, _ := tc.proxy.remoteAddr(r); got != tc.want {
+				t.Fatalf("remoteAddr: got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestForwardedChain(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	p := &Proxy{TrustedProxies: trusted}
+	for _, tc := range []struct {
+		remote, xff, want string
+	}{
+		{remote: "203.0.113.7:1234", xff: "192.0.2.1", want: "203.0.113.7"},
+		{remote: "10.0.0.1:1234", xff: "192.0.2.1", want: "192.0.2.1, 10.0.0.1"},
+		{remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{remote: "@", xff: "192.0.2.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := p.forwardedChain(r); got != tc.want {
+			t.Errorf("peer %s, X-Forwarded-For %q: got chain %q, want %q", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artyom/uwsgi"
+)
+
+// bench replays requests listed in a file directly against the backend and
+// prints latency statistics.
+func bench(argv []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	backend := fs.String("backend", "", "uWSGI backend `address`: path to unix socket or host:port")
+	concurrency := fs.Int("c", 10, "number of concurrent requests")
+	rate := fs.Float64("rate", 0, "max requests per second, 0 means no limit")
+	total := fs.Int("n", 0, "number of requests to send, 0 means one per line in file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: uwsgi-proxy bench [flags] url-file\n\n"+
+			"Each line of url-file is either URL or method followed by URL.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(argv)
+	if *backend == "" {
+		return errors.New("-backend must be set")
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *concurrency < 1 {
+		return errors.New("-c must be positive")
+	}
+	reqs, err := readRequests(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	n := *total
+	if n <= 0 {
+		n = len(reqs)
+	}
+	p := &uwsgi.Proxy{DialContext: backendDial(*backend)}
+
+	jobs := make(chan *http.Request)
+	go func() {
+		defer close(jobs)
+		var tick <-chan time.Time
+		if *rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for i := 0; i < n; i++ {
+			if tick != nil {
+				<-tick
+			}
+			jobs <- reqs[i%len(reqs)]
+		}
+	}()
+	var mu sync.Mutex
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	var wg sync.WaitGroup
+	begin := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				res := p.ServeHTTPResult(&discardWriter{h: make(http.Header)}, r.Clone(r.Context()))
+				mu.Lock()
+				latencies = append(latencies, res.Total)
+				statuses[res.Code()]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(begin)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("requests:\t%d in %v, %.1f/s\n", len(latencies), elapsed.Round(time.Millisecond),
+		float64(len(latencies))/elapsed.Seconds())
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("status %d:\t%d\n", code, statuses[code])
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99, 1} {
+		fmt.Printf("p%g:\t%v\n", q*100, percentile(latencies, q).Round(time.Microsecond))
+	}
+	return nil
+}
+
+// readRequests reads requests from file where each line is either URL or
+// method followed by URL. Empty lines and lines starting with # are skipped.
+func readRequests(name string) ([]*http.Request, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var reqs []*http.Request
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		method, u := http.MethodGet, fields[0]
+		if len(fields) > 1 {
+			method, u = fields[0], fields[1]
+		}
+		r, err := http.NewRequest(method, u, http.NoBody)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		r.RemoteAddr = "127.0.0.1:0"
+		r.RequestURI = r.URL.RequestURI()
+		reqs = append(reqs, r)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("%s: no requests", name)
+	}
+	return reqs, nil
+}
+
+// percentile returns q-th quantile of sorted durations.
+func percentile(d []time.Duration, q float64) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	i := int(q*float64(len(d))+0.5) - 1
+	i = max(0, min(i, len(d)-1))
+	return d[i]
+}
+
+// discardWriter is a http.ResponseWriter discarding response.
+type discardWriter struct{ h http.Header }
+
+func (w *discardWriter) Header() http.Header         { return w.h }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
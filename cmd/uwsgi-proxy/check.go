@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/artyom/uwsgi"
+)
+
+// check validates configuration given with flags and -routing file, verifies
+// that TLS material loads and backends are reachable, and prints the routing
+// table.
+func check(args args) error {
+	if err := args.validate(); err != nil {
+		return err
+	}
+	var errs []error
+	if len(args.https) != 0 {
+		if _, _, err := tlsSetup(args); err != nil {
+			errs = append(errs, fmt.Errorf("TLS: %w", err))
+		}
+		if args.cert == "" && args.cacheDir != "" {
+			if err := os.MkdirAll(args.cacheDir, 0700); err != nil {
+				errs = append(errs, fmt.Errorf("ACME cache: %w", err))
+			}
+		}
+	}
+	var backends []string
+	if args.routing != "" {
+		c, err := readRouting(args.routing)
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		backends = c.Backends
+	} else {
+		backends = strings.Split(args.backend, ",")
+	}
+	for i, s := range backends {
+		network, address := backendAddr(s)
+		status := "ok"
+		p := &uwsgi.Proxy{DialContext: backendDial(s)}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		proto, err := p.Detect(ctx)
+		cancel()
+		switch {
+		case err != nil:
+			status = err.Error()
+			errs = append(errs, fmt.Errorf("backend %s: %w", s, err))
+		case proto != uwsgi.ProtocolUwsgi:
+			status = "speaks " + proto.String() + ", not uwsgi"
+			errs = append(errs, fmt.Errorf("backend %s: expected uwsgi protocol, detected %v", s, proto))
+		}
+		role := "primary"
+		switch {
+		case len(backends) > 1 && args.balance != "failover":
+			role = args.balance
+		case i > 0:
+			role = fmt.Sprintf("fallback %d", i)
+		}
+		fmt.Printf("backend\t%s:%s\t%s\t%s\n", network, address, role, status)
+	}
+	for _, addr := range args.http {
+		fmt.Printf("listen\thttp://%s\t-> backend\n", addr)
+	}
+	for _, addr := range args.https {
+		certs := "certificate from " + args.cert
+		if args.cert == "" {
+			certs = "ACME certificates for " + strings.Join(args.domains, ", ")
+		}
+		fmt.Printf("listen\thttps://%s\t-> backend\t%s\n", addr, certs)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,445 @@
+// Command uwsgi-proxy serves HTTP(S) requests by proxying them to an uWSGI
+// backend.
+//
+// Usage example:
+//
+//	uwsgi-proxy -backend /path/to/uwsgi.socket \
+//		-https :443 -http :80 -domain example.com \
+//		-http 127.0.0.1:8080
+//
+// Backend address is either a path to unix socket or host:port pair; it may
+// be prefixed with "unix:" or "tcp:" to set network explicitly. Multiple
+// comma-separated addresses can be given, they're tried in order, so that
+// local socket can be backed by remote ones:
+//
+//	uwsgi-proxy -backend /path/to/uwsgi.socket,10.0.0.2:3031 -http :80
+//
+// Alternatively, -balance flag spreads requests across all of them, skipping
+// backends that fail to accept connections:
+//
+//	uwsgi-proxy -backend 10.0.0.2:3031,10.0.0.3:3031 -balance least-conn -http :80
+//
+// Both -http and -https flags can be repeated to listen on multiple
+// addresses. HTTPS listeners use certificates from files set with -cert and
+// -key flags, or otherwise certificates obtained automatically from Let's
+// Encrypt (ACME) for domains set with -domain flags. Plaintext listeners
+// also answer ACME HTTP-01 challenges.
+//
+// HTTPS listeners support HTTP/2, plaintext listeners support HTTP/2 with
+// prior knowledge (h2c), unless disabled with -h2c=false flag. Cleartext
+// upgrade from HTTP/1.1 to HTTP/2 is not supported.
+//
+// Optional admin listener set with -admin flag serves profiling data at
+// /debug/pprof/ and runtime stats (memory, GC, goroutines) at /debug/vars.
+// JSON API at /api/ lists backends and enables or disables them when
+// -balance is used, switches maintenance and read-only modes, changes log
+// level, and shows live configuration, see uwsgi.Admin for details:
+//
+//	curl -X PUT -d '{"level": "debug"}' http://localhost:6060/api/log-level
+//
+// In read-only mode, requests with methods other than GET, HEAD, OPTIONS,
+// and TRACE get 503 Service Unavailable reply, e.g. during backend database
+// failover:
+//
+//	curl -X PUT -d '{"on": true, "retryAfter": 60}' http://localhost:6060/api/read-only
+//
+// In staging environments, -faults flag enables fault injection, controlled
+// at runtime at /api/faults, see uwsgi.FaultInjector:
+//
+//	curl -X PUT -d '{"dropPercent": 10}' http://localhost:6060/api/faults
+//
+// With -balance, the list of backends can be changed at runtime; changes are
+// reported, and only validated with dry-run parameter:
+//
+//	curl -X PUT -d '{"backends": ["10.0.0.2:3031", "10.0.0.4:3031"]}' \
+//		http://localhost:6060/api/routing?dry-run=1
+//
+// Balanced backends can also be listed in a JSON file set with -routing
+// flag instead of -backend, in the same format. On SIGHUP signal, the file is
+// read again, and changes are applied and logged:
+//
+//	uwsgi-proxy -routing backends.json -balance least-conn -http :80
+//	kill -HUP $(pidof uwsgi-proxy)
+//
+// Admin listener has no authentication, so it should listen on a loopback or
+// otherwise private address.
+//
+// On SIGUSR2 signal, uwsgi-proxy starts a new process from its executable
+// with the same arguments, passing it the listening sockets, and once the
+// new process is ready, gracefully shuts down, so the binary can be upgraded
+// without refusing connections.
+//
+// Configuration is given with flags, and -routing file if it's set. It can
+// be verified without starting listeners by running check command with the
+// same flags, e.g. in CI/CD pipelines:
+//
+//	uwsgi-proxy check [flags]
+//
+// It validates flags and -routing file, loads TLS certificates, checks that
+// backends are reachable and speak uwsgi protocol, and prints the routing
+// table. It exits with non-zero status if any problem is found.
+//
+// For capacity planning, requests listed in a file can be replayed directly
+// against the backend, bypassing HTTP listeners:
+//
+//	uwsgi-proxy bench -backend /path/to/uwsgi.socket -c 50 -n 10000 urls.txt
+//
+// Each line of the file is either URL or method followed by URL. Run
+// "uwsgi-proxy bench -h" for details.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/artyom/uwsgi"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func main() {
+	args := args{}
+	flag.StringVar(&args.backend, "backend", "", "uWSGI backend `address`: path to unix socket or host:port,\n"+
+		"multiple comma-separated addresses are combined according to -balance flag")
+	flag.StringVar(&args.routing, "routing", "", "JSON `file` listing backends to use with -balance instead of -backend,\n"+
+		`like {"backends": ["10.0.0.2:3031"]}; it's read again on SIGHUP`)
+	flag.StringVar(&args.balance, "balance", "failover", "how to use multiple backends: `strategy` is one of\n"+
+		"failover (try in order), round-robin, least-conn, or random")
+	flag.Var(&args.http, "http", "plaintext HTTP listen `address`, can be repeated")
+	flag.Var(&args.https, "https", "HTTPS listen `address`, can be repeated")
+	flag.Var(&args.domains, "domain", "`domain` to get ACME certificate for, can be repeated")
+	flag.StringVar(&args.cacheDir, "cache", defaultCacheDir(), "`directory` to cache ACME certificates")
+	flag.StringVar(&args.email, "email", "", "contact `email` for ACME account")
+	flag.StringVar(&args.cert, "cert", "", "TLS certificate `file` (PEM), disables ACME")
+	flag.StringVar(&args.key, "key", "", "TLS private key `file` (PEM)")
+	flag.BoolVar(&args.h2c, "h2c", true, "support HTTP/2 with prior knowledge on plaintext listeners")
+	flag.StringVar(&args.admin, "admin", "", "admin listen `address` serving /debug/pprof/, /debug/vars, and /api/")
+	flag.BoolVar(&args.faults, "faults", false, "enable fault injection controlled at /api/faults of admin listener, for staging")
+	log.SetFlags(0)
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := bench(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	cmd := run
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		cmd = check
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+	if err := cmd(args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type args struct {
+	backend         string
+	routing         string
+	balance         string
+	http, https     listFlag
+	domains         listFlag
+	cacheDir, email string
+	cert, key       string
+	h2c             bool
+	admin           string
+	faults          bool
+}
+
+func run(args args) error {
+	if err := args.validate(); err != nil {
+		return err
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	var dial uwsgi.DialFunc
+	var balancer *uwsgi.Balancer
+	if args.routing != "" {
+		balancer = &uwsgi.Balancer{Strategy: balanceStrategies[args.balance]}
+		dial = balancer.DialContext
+	} else {
+		dial, balancer = backendsDial(args.backend, args.balance)
+	}
+	if balancer != nil {
+		balancer.ErrorLog = logger
+	}
+	proxy := &uwsgi.Proxy{DialContext: dial}
+	if args.faults {
+		proxy.Faults = new(uwsgi.FaultInjector)
+	}
+	var handler http.Handler = proxy
+	admin := &uwsgi.Admin{Proxy: proxy, Balancer: balancer, NewDial: backendDial}
+	if args.routing != "" {
+		if _, err := applyRouting(admin, args.routing); err != nil {
+			return err
+		}
+	}
+
+	var servers []*http.Server
+	plainHandler := handler
+	if len(args.https) != 0 {
+		tlsConfig, acmeHandler, err := tlsSetup(args)
+		if err != nil {
+			return err
+		}
+		if acmeHandler != nil {
+			plainHandler = acmeHandler(handler)
+		}
+		for _, addr := range args.https {
+			srv := uwsgi.NewServer(addr, handler)
+			srv.TLSConfig = tlsConfig
+			srv.ErrorLog = logger
+			servers = append(servers, srv)
+		}
+	}
+	var plainProtocols http.Protocols
+	plainProtocols.SetHTTP1(true)
+	plainProtocols.SetUnencryptedHTTP2(args.h2c)
+	for _, addr := range args.http {
+		srv := uwsgi.NewServer(addr, plainHandler)
+		srv.ErrorLog = logger
+		srv.Protocols = &plainProtocols
+		servers = append(servers, srv)
+	}
+	if args.admin != "" {
+		servers = append(servers, &http.Server{
+			Addr:     args.admin,
+			Handler:  adminHandler(admin),
+			ErrorLog: logger,
+		})
+	}
+
+	inherited, ready, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	addrs := make([]string, len(servers))
+	listeners := make([]net.Listener, len(servers))
+	for i, srv := range servers {
+		addrs[i] = srv.Addr
+		if ln, ok := inherited[srv.Addr]; ok {
+			listeners[i] = ln
+			continue
+		}
+		if listeners[i], err = net.Listen("tcp", srv.Addr); err != nil {
+			return err
+		}
+	}
+	errCh := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *http.Server, ln net.Listener) {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != http.ErrServerClosed {
+				errCh <- fmt.Errorf("%s: %w", srv.Addr, err)
+			}
+		}(srv, listeners[i])
+	}
+	if ready != nil {
+		ready.Write([]byte{1})
+		ready.Close()
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	if upgradeSignal != nil {
+		signal.Notify(sigCh, upgradeSignal)
+	}
+wait:
+	for {
+		select {
+		case err = <-errCh:
+			break wait
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				if args.routing == "" {
+					logger.Print("SIGHUP received, but -routing is not set")
+					continue
+				}
+				d, err := applyRouting(admin, args.routing)
+				if err != nil {
+					logger.Printf("routing reload: %v", err)
+					continue
+				}
+				logger.Printf("routing reloaded: %v", d)
+				continue
+			}
+			if sig != upgradeSignal {
+				logger.Printf("%v received, shutting down", sig)
+				break wait
+			}
+			if err := upgrade(addrs, listeners); err != nil {
+				logger.Printf("binary upgrade: %v", err)
+				continue
+			}
+			logger.Print("new process is ready, shutting down")
+			break wait
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		srv.Shutdown(ctx)
+	}
+	return err
+}
+
+func (args args) validate() error {
+	switch {
+	case args.backend == "" && args.routing == "":
+		return errors.New("-backend or -routing must be set")
+	case args.backend != "" && args.routing != "":
+		return errors.New("-backend and -routing are mutually exclusive")
+	}
+	if len(args.http) == 0 && len(args.https) == 0 {
+		return errors.New("at least one of -http or -https must be set")
+	}
+	if args.faults && args.admin == "" {
+		return errors.New("-faults requires -admin")
+	}
+	if _, ok := balanceStrategies[args.balance]; !ok && args.balance != "failover" {
+		return fmt.Errorf("unsupported -balance strategy %q", args.balance)
+	}
+	if args.routing != "" && args.balance == "failover" {
+		return errors.New("-routing requires -balance strategy other than failover")
+	}
+	return nil
+}
+
+// backendsDial returns dialer for comma-separated backend addresses as given
+// with -backend flag, combined according to balance strategy, and Balancer
+// it's using, if any.
+func backendsDial(backends, balance string) (uwsgi.DialFunc, *uwsgi.Balancer) {
+	addrs := strings.Split(backends, ",")
+	if len(addrs) == 1 {
+		return backendDial(addrs[0]), nil
+	}
+	strategy, ok := balanceStrategies[balance]
+	if !ok {
+		var dials []uwsgi.DialFunc
+		for _, s := range addrs {
+			dials = append(dials, backendDial(s))
+		}
+		return uwsgi.Failover(dials...), nil
+	}
+	b := &uwsgi.Balancer{Strategy: strategy}
+	for _, s := range addrs {
+		b.Add(s, backendDial(s))
+	}
+	return b.DialContext, b
+}
+
+// readRouting reads backends listed in JSON file set with -routing flag.
+func readRouting(name string) (uwsgi.RoutingConfig, error) {
+	var c uwsgi.RoutingConfig
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return c, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(c.Routes) != 0 {
+		return c, fmt.Errorf("%s: routes are not supported", name)
+	}
+	if err := c.Validate(); err != nil {
+		return c, fmt.Errorf("%s: %w", name, err)
+	}
+	return c, nil
+}
+
+// applyRouting applies backends listed in JSON file set with -routing flag
+// to admin Balancer, returning changes made.
+func applyRouting(admin *uwsgi.Admin, name string) (uwsgi.RoutingDiff, error) {
+	c, err := readRouting(name)
+	if err != nil {
+		return uwsgi.RoutingDiff{}, err
+	}
+	return admin.Apply(c, false)
+}
+
+var balanceStrategies = map[string]uwsgi.BalanceStrategy{
+	"round-robin": uwsgi.BalanceRoundRobin,
+	"least-conn":  uwsgi.BalanceLeastConn,
+	"random":      uwsgi.BalanceRandom,
+}
+
+// backendDial returns dialer for the backend address as given with -backend
+// flag.
+func backendDial(s string) uwsgi.DialFunc {
+	network, address := backendAddr(s)
+	return uwsgi.Dial(network, address).WithTimeout(5 * time.Second)
+}
+
+// tlsSetup returns TLS configuration for HTTPS listeners. If certificates are
+// obtained with ACME, it also returns a function wrapping plaintext handler
+// so that it answers ACME HTTP-01 challenges.
+func tlsSetup(args args) (*tls.Config, func(http.Handler) http.Handler, error) {
+	if args.cert != "" || args.key != "" {
+		cert, err := tls.LoadX509KeyPair(args.cert, args.key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil, nil
+	}
+	if len(args.domains) == 0 {
+		return nil, nil, errors.New("either -domain or -cert and -key must be set for HTTPS listeners")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(args.domains...),
+		Email:      args.email,
+	}
+	if args.cacheDir != "" {
+		m.Cache = autocert.DirCache(args.cacheDir)
+	}
+	return m.TLSConfig(), m.HTTPHandler, nil
+}
+
+// backendAddr splits backend address into network and address parts.
+func backendAddr(s string) (network, address string) {
+	switch {
+	case strings.HasPrefix(s, "unix:"):
+		return "unix", strings.TrimPrefix(s, "unix:")
+	case strings.HasPrefix(s, "tcp:"):
+		return "tcp", strings.TrimPrefix(s, "tcp:")
+	case strings.Contains(s, "/"):
+		return "unix", s
+	}
+	return "tcp", s
+}
+
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "uwsgi-proxy")
+}
+
+// listFlag is a flag.Value collecting repeated flag values.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ", ") }
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
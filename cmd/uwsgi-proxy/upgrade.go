@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Listeners are passed to the new process on binary upgrade as extra files
+// (starting from descriptor 3) in the order of addresses listed in the
+// listenersEnv environment variable, followed by the write end of a pipe the
+// new process closes once it's ready to serve.
+const listenersEnv = "UWSGI_PROXY_LISTENERS"
+
+// inheritedListeners returns listeners passed by the parent process on binary
+// upgrade, keyed by address, and the file to report readiness on. Both are
+// nil if process was not started this way.
+func inheritedListeners() (map[string]net.Listener, *os.File, error) {
+	s := os.Getenv(listenersEnv)
+	if s == "" {
+		return nil, nil, nil
+	}
+	os.Unsetenv(listenersEnv)
+	addrs := strings.Split(s, ",")
+	out := make(map[string]net.Listener, len(addrs))
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("inherited listener %s: %w", addr, err)
+		}
+		out[addr] = ln
+	}
+	return out, os.NewFile(uintptr(3+len(addrs)), "ready"), nil
+}
+
+// upgrade starts a new process from the current executable with the same
+// arguments, passing it listeners for the given addresses, and waits until
+// it's ready to serve.
+func upgrade(addrs []string, listeners []net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range listeners {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %v cannot be passed to the new process", ln.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+	files = append(files, pw)
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), listenersEnv+"="+strings.Join(addrs, ","))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	pw.Close()
+	pr.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if n, _ := pr.Read(make([]byte, 1)); n == 0 {
+		cmd.Process.Kill()
+		return errors.New("new process failed to start")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package uwsgi
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type ctxKey int
+
+const (
+	varsKey ctxKey = iota
+	mountKey
+	traceKey
+	requestKey
+	resultKey
+)
+
+// WithVars returns a shallow copy of r with its context carrying additional
+// variables for Proxy to pass to the backend. This allows middleware in front
+// of Proxy to add request-specific variables. Variables are appended to
+// those already attached to the request.
+func WithVars(r *http.Request, vars ...Var) *http.Request {
+	old := ctxVars(r.Context())
+	all := make([]Var, 0, len(old)+len(vars))
+	all = append(append(all, old...), vars...)
+	return r.WithContext(context.WithValue(r.Context(), varsKey, all))
+}
+
+func ctxVars(ctx context.Context) []Var {
+	vars, _ := ctx.Value(varsKey).([]Var)
+	return vars
+}
+
+// withRequest returns ctx carrying r, so that Balancer can see request it
+// dials backend for.
+func withRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestKey, r)
+}
+
+func ctxRequest(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestKey).(*http.Request)
+	return r
+}
+
+// withMount returns a shallow copy of r with its context carrying the path
+// prefix the application is mounted at, which Proxy passes as SCRIPT_NAME.
+func withMount(r *http.Request, prefix string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), mountKey, prefix))
+}
+
+func ctxMount(ctx context.Context) string {
+	s, _ := ctx.Value(mountKey).(string)
+	return s
+}
+
+// forwardedPrefix returns X-Forwarded-Prefix value for application mounted
+// at mount behind a proxy that sent prefix in the same header; prefix must
+// be empty unless headers of that proxy are trusted.
+func forwardedPrefix(prefix, mount string) string {
+	if i := strings.IndexByte(prefix, ','); i != -1 {
+		prefix = prefix[:i] // only the first one is used, like ProxyFix does
+	}
+	return strings.TrimSuffix(strings.TrimSpace(prefix), "/") + mount
+}
+
+// hasPathPrefix reports whether path is equal to prefix or starts with prefix
+// followed by a slash.
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
@@ -0,0 +1,186 @@
+package uwsgi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DialFunc connects to uWSGI backend. It has the same signature as Handler
+// and Proxy.DialContext, its methods can be chained to build dialers with
+// additional features:
+//
+//	dial := uwsgi.Dial("unix", "/path/to/uwsgi.socket").
+//		WithTimeout(time.Second).WithRetry(3)
+//	log.Fatal(http.ListenAndServe("localhost:8080", uwsgi.Handler(dial)))
+type DialFunc func(context.Context) (net.Conn, error)
+
+// Dial returns DialFunc connecting to the address on the named network using
+// net.Dialer.
+func Dial(network, address string) DialFunc {
+	var d net.Dialer
+	return func(ctx context.Context) (net.Conn, error) {
+		return d.DialContext(ctx, network, address)
+	}
+}
+
+// WithTimeout returns DialFunc that limits each connection attempt to the
+// given duration.
+func (dial DialFunc) WithTimeout(d time.Duration) DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return dial(ctx)
+	}
+}
+
+// WithRetry returns DialFunc that retries temporary errors up to n times with
+// exponential backoff, the same way Proxy does on its own. If n is not
+// positive, dial is returned as is.
+func (dial DialFunc) WithRetry(n int) DialFunc {
+	if n <= 0 {
+		return dial
+	}
+	return func(ctx context.Context) (net.Conn, error) {
+		return retryDial(ctx, dial, n, 0, nil, isTemporary)
+	}
+}
+
+// WithMetrics returns DialFunc that calls fn after each connection attempt
+// with its duration and error.
+func (dial DialFunc) WithMetrics(fn func(time.Duration, error)) DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		begin := time.Now()
+		conn, err := dial(ctx)
+		fn(time.Since(begin), err)
+		return conn, err
+	}
+}
+
+// WithTLS returns DialFunc that establishes TLS session with given
+// configuration over connections, completing handshake before returning.
+// Unless config has ClientSessionCache set, sessions are cached in memory, so
+// that subsequent connections resume them instead of doing full handshakes.
+// If config is nil or has neither ServerName nor InsecureSkipVerify set,
+// backend certificate is verified against the host of the remote address,
+// which is usually an IP address, so set ServerName for certificates issued
+// for a host name.
+func (dial DialFunc) WithTLS(config *tls.Config) DialFunc {
+	return dial.WithTLSStats(config, nil)
+}
+
+// WithTLSStats works like WithTLS, additionally counting handshakes in stats,
+// which lets operators verify that sessions are resumed. Reuse of
+// connections themselves is reported by Proxy.PoolStats.
+func (dial DialFunc) WithTLSStats(config *tls.Config, stats *TLSStats) DialFunc {
+	if config == nil {
+		config = new(tls.Config)
+	}
+	if config.ClientSessionCache == nil {
+		config = config.Clone()
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return func(ctx context.Context) (net.Conn, error) {
+		conn, err := dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cfg := config
+		if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+			cfg = cfg.Clone()
+			cfg.ServerName, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+		}
+		tconn := tls.Client(conn, cfg)
+		if err := tconn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			if stats != nil {
+				stats.failed.Add(1)
+			}
+			return nil, err
+		}
+		if stats != nil {
+			stats.handshakes.Add(1)
+			if tconn.ConnectionState().DidResume {
+				stats.resumed.Add(1)
+			}
+		}
+		return tconn, nil
+	}
+}
+
+// TLSStats counts TLS handshakes done by dialers created with
+// DialFunc.WithTLSStats. It's safe for concurrent use.
+type TLSStats struct {
+	handshakes, resumed, failed atomic.Int64
+}
+
+// Handshakes returns number of successful handshakes, including resumed ones.
+func (s *TLSStats) Handshakes() int64 { return s.handshakes.Load() }
+
+// Resumed returns number of handshakes that resumed previous session.
+func (s *TLSStats) Resumed() int64 { return s.resumed.Load() }
+
+// Failed returns number of failed handshakes.
+func (s *TLSStats) Failed() int64 { return s.failed.Load() }
+
+// Failover returns DialFunc that tries dials in the given order, returning
+// the first connection established. This allows to prefer local backend and
+// fall back to remote ones if it's down:
+//
+//	dial := uwsgi.Failover(
+//		uwsgi.Dial("unix", "/path/to/uwsgi.socket"),
+//		uwsgi.Dial("tcp", "10.0.0.2:3031").WithTimeout(time.Second),
+//	)
+//
+// If all attempts fail, error of the last one is returned.
+func Failover(dials ...DialFunc) DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		err := errors.New("no backends to dial")
+		for _, dial := range dials {
+			var conn net.Conn
+			if conn, err = dial(ctx); err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+		return nil, err
+	}
+}
+
+// retryDial calls dial retrying errors for which retryable returns true with
+// exponential backoff. It gives up after n retries if n is positive, once
+// delay would exceed maxDelay if it's positive, or once budget, if not nil,
+// is exhausted.
+func retryDial(ctx context.Context, dial DialFunc, n int, maxDelay time.Duration, budget *RetryBudget, retryable func(error) bool) (net.Conn, error) {
+	var tempDelay time.Duration
+	for i := 0; ; i++ {
+		conn, err := dial(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		if !retryable(err) || (n > 0 && i >= n) {
+			return nil, err
+		}
+		if tempDelay == 0 {
+			tempDelay = 5 * time.Millisecond
+		} else {
+			tempDelay *= 2
+		}
+		if maxDelay > 0 && tempDelay > maxDelay {
+			return nil, err
+		}
+		if budget != nil && !budget.Withdraw() {
+			return nil, err
+		}
+		select {
+		case <-time.After(tempDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package uwsgi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithTLSServerName(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // connections close right after handshake
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	stats := new(TLSStats)
+	// certificate of the test server is valid for 127.0.0.1
+	dial := Dial("tcp", srv.Listener.Addr().String()).WithTLSStats(&tls.Config{RootCAs: roots}, stats)
+	for range 2 {
+		conn, err := dial(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if stats.Handshakes() != 2 || stats.Failed() != 0 {
+		t.Fatalf("got %d handshakes, %d failed, want 2 and 0", stats.Handshakes(), stats.Failed())
+	}
+}
@@ -0,0 +1,100 @@
+package uwsgi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// DialErrorKind is a class of backend connection errors, see
+// ClassifyDialError and Proxy.DialErrors.
+type DialErrorKind int
+
+const (
+	DialErrorOther DialErrorKind = iota // not classified
+	DialRefused                         // nothing listens on the address (ECONNREFUSED)
+	DialNoSocket                        // unix socket file doesn't exist (ENOENT)
+	DialPermission                      // access to unix socket denied (EACCES)
+	DialOverloaded                      // unix socket listen queue is full (EAGAIN)
+	DialTimeout                         // connection attempt timed out
+)
+
+func (k DialErrorKind) String() string {
+	switch k {
+	case DialErrorOther:
+		return "other"
+	case DialRefused:
+		return "refused"
+	case DialNoSocket:
+		return "no socket"
+	case DialPermission:
+		return "permission denied"
+	case DialOverloaded:
+		return "overloaded"
+	case DialTimeout:
+		return "timeout"
+	}
+	return "DialErrorKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// ClassifyDialError returns class of the backend connection error.
+func ClassifyDialError(err error) DialErrorKind {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialRefused
+	case errors.Is(err, syscall.ENOENT):
+		return DialNoSocket
+	case errors.Is(err, syscall.EACCES), errors.Is(err, os.ErrPermission):
+		return DialPermission
+	case errors.Is(err, syscall.EAGAIN):
+		return DialOverloaded
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return DialTimeout
+	}
+	return DialErrorOther
+}
+
+// DialPolicy defines how Proxy handles backend connection errors of some
+// kind, see Proxy.DialErrors.
+type DialPolicy struct {
+	// Status is the status code of reply sent to the client.
+	Status int
+
+	// Retry makes Proxy retry connection attempts with exponential
+	// backoff for up to a second, or while RetryBudget allows.
+	Retry bool
+}
+
+// defaultDialPolicies are used for error kinds missing from Proxy.DialErrors.
+var defaultDialPolicies = map[DialErrorKind]DialPolicy{
+	DialRefused:    {Status: http.StatusServiceUnavailable},
+	DialNoSocket:   {Status: http.StatusServiceUnavailable},
+	DialPermission: {Status: http.StatusServiceUnavailable},
+	DialOverloaded: {Status: http.StatusGatewayTimeout, Retry: true},
+	DialTimeout:    {Status: http.StatusGatewayTimeout, Retry: true},
+}
+
+// dialPolicy returns policy for backend connection error.
+func (p *Proxy) dialPolicy(err error) DialPolicy {
+	kind := ClassifyDialError(err)
+	if pol, ok := p.DialErrors[kind]; ok {
+		return pol
+	}
+	if pol, ok := defaultDialPolicies[kind]; ok {
+		return pol
+	}
+	if isTemporary(err) {
+		return DialPolicy{Status: http.StatusGatewayTimeout, Retry: true}
+	}
+	return DialPolicy{Status: http.StatusServiceUnavailable}
+}
+
+// isTemporary reports whether err is a temporary network error.
+func isTemporary(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
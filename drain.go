@@ -0,0 +1,75 @@
+package uwsgi
+
+import (
+	"net"
+	"time"
+)
+
+// Drain stops Proxy from accepting new requests, which are rejected with
+// 503 Service Unavailable status from now on, and waits for in-flight
+// exchanges with the backend to complete. Backend connections still in use
+// once grace period expires are forcibly closed. Drain returns the number of
+// exchanges cut short this way.
+//
+// Drain is meant to be called when Proxy is being removed from service, e.g.
+// on configuration reload or when its backend is taken out of rotation.
+func (p *Proxy) Drain(grace time.Duration) int {
+	p.mu.Lock()
+	p.draining = true
+	if p.drained == nil {
+		p.drained = make(chan struct{})
+		if len(p.conns) == 0 {
+			close(p.drained)
+		}
+	}
+	drained := p.drained
+	p.mu.Unlock()
+	p.CloseIdleConnections()
+	t := time.NewTimer(grace)
+	defer t.Stop()
+	select {
+	case <-drained:
+		return 0
+	case <-t.C:
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	return len(p.conns)
+}
+
+// track registers backend connection as being in use, it reports false if
+// Proxy is draining.
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = make(map[net.Conn]struct{})
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+	if p.draining && len(p.conns) == 0 {
+		select {
+		case <-p.drained:
+		default:
+			close(p.drained)
+		}
+	}
+}
+
+func (p *Proxy) isDraining() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.draining
+}
@@ -0,0 +1,64 @@
+package uwsgi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		grace  time.Duration
+		closed int
+		code   int
+	}{
+		{name: "completes", grace: time.Minute, closed: 0, code: http.StatusOK},
+		{name: "cut short", grace: 10 * time.Millisecond, closed: 1, code: http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			b := &testBackend{handle: func(vars map[string]string, body []byte) string {
+				close(started)
+				<-release
+				return okResponse(vars, body)
+			}}
+			p := &Proxy{DialContext: b.dial}
+			codes := make(chan int, 1)
+			go func() {
+				w := httptest.NewRecorder()
+				p.ServeHTTPResult(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				codes <- w.Code
+			}()
+			<-started
+			drained := make(chan int, 1)
+			begin := time.Now()
+			go func() { drained <- p.Drain(tc.grace) }()
+			if tc.closed == 0 {
+				time.Sleep(20 * time.Millisecond)
+				close(release)
+			} else {
+				defer close(release)
+			}
+			if n := <-drained; n != tc.closed {
+				t.Fatalf("Drain closed %d connections, want %d", n, tc.closed)
+			}
+			if d := time.Since(begin); d > time.Second {
+				t.Fatalf("Drain took %v", d)
+			}
+			if code := <-codes; code != tc.code {
+				t.Fatalf("in-flight request: got status %d, want %d", code, tc.code)
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("request after Drain: got status %d, want 503", w.Code)
+			}
+			if n := p.Drain(time.Minute); n != 0 {
+				t.Fatalf("repeated Drain closed %d connections", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package uwsgi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// FromEnv returns Proxy configured from environment variables:
+//
+//	UWSGI_ADDR — backend address, required
+//	UWSGI_NETWORK — "unix" or "tcp"; if unset, "unix" is used for addresses
+//		containing "/", and "tcp" otherwise
+//	UWSGI_TIMEOUT — backend connect timeout, like "5s"
+//	UWSGI_IDLE_TIMEOUT — Proxy.ResponseIdleTimeout, like "1m"
+//	UWSGI_PROTOCOL — "uwsgi" (default), "http", or "auto", see Protocol
+//	UWSGI_BUFFER_SIZE — Proxy.BufferSize, backend --buffer-size value
+//	UWSGI_POST_BUFFERING — Proxy.PostBuffering, in bytes
+//
+// Usage example:
+//
+//	p, err := uwsgi.FromEnv()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(http.ListenAndServe(os.Getenv("LISTEN_ADDR"), p))
+func FromEnv() (*Proxy, error) {
+	addr := os.Getenv("UWSGI_ADDR")
+	if addr == "" {
+		return nil, errors.New("UWSGI_ADDR is not set")
+	}
+	network := os.Getenv("UWSGI_NETWORK")
+	switch network {
+	case "":
+		network = addrNetwork(addr)
+	case "unix", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("UWSGI_NETWORK: unsupported network %q", network)
+	}
+	dial := Dial(network, addr)
+	p := new(Proxy)
+	var err error
+	var timeout time.Duration
+	if timeout, err = envDuration("UWSGI_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		dial = dial.WithTimeout(timeout)
+	}
+	p.DialContext = dial
+	if p.ResponseIdleTimeout, err = envDuration("UWSGI_IDLE_TIMEOUT"); err != nil {
+		return nil, err
+	}
+	switch s := os.Getenv("UWSGI_PROTOCOL"); s {
+	case "", ProtocolUwsgi.String():
+	case ProtocolHTTP.String():
+		p.Protocol = ProtocolHTTP
+	case ProtocolAuto.String():
+		p.Protocol = ProtocolAuto
+	default:
+		return nil, fmt.Errorf("UWSGI_PROTOCOL: unsupported protocol %q", s)
+	}
+	var n int64
+	if n, err = envInt("UWSGI_BUFFER_SIZE"); err != nil {
+		return nil, err
+	}
+	p.BufferSize = int(n)
+	if p.PostBuffering, err = envInt("UWSGI_POST_BUFFERING"); err != nil {
+		return nil, err
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func envDuration(name string) (time.Duration, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s: negative duration", name)
+	}
+	return d, nil
+}
+
+func envInt(name string) (int64, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s: negative value", name)
+	}
+	return n, nil
+}
@@ -0,0 +1,30 @@
+package uwsgi
+
+import (
+	"errors"
+	"net/http"
+)
+
+// StatusError is an error that can be returned by hooks (like Proxy.Admit)
+// to make Proxy reply to the client with the specific status code.
+type StatusError struct {
+	Code    int    // HTTP status code
+	Message string // response text; http.StatusText(Code) if empty
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return http.StatusText(e.Code)
+}
+
+// errorStatus returns status code and response text for the error returned
+// by a hook: if err is not a *StatusError, default code is used.
+func errorStatus(err error, code int) (int, string) {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code, se.Error()
+	}
+	return code, http.StatusText(code)
+}
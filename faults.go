@@ -0,0 +1,109 @@
+package uwsgi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Faults describes faults injected by FaultInjector. Percentages are in
+// [0, 100] range.
+type Faults struct {
+	// Latency is added before connecting to backend for LatencyPercent of
+	// requests.
+	Latency        time.Duration `json:"latency"`
+	LatencyPercent float64       `json:"latencyPercent"`
+
+	// DropPercent of requests have their backend connection dropped right
+	// after it's established.
+	DropPercent float64 `json:"dropPercent"`
+
+	// TruncatePercent of responses have their body cut short at a random
+	// point within the first TruncateMax bytes (1024 if zero).
+	TruncatePercent float64 `json:"truncatePercent"`
+	TruncateMax     int64   `json:"truncateMax"`
+}
+
+// FaultInjector injects faults into Proxy exchanges with its backend; it's
+// meant to be used in staging environments to validate how application and
+// proxy behave on backend failures. Use Proxy.Faults to enable it.
+//
+// FaultInjector is a http.Handler allowing to control it at runtime, when
+// mounted on a debug endpoint: GET request returns current Faults as JSON,
+// PUT request sets Faults from JSON in the request body, DELETE request
+// disables fault injection. Admin serves it at /faults.
+type FaultInjector struct {
+	mu     sync.RWMutex
+	faults Faults
+}
+
+// Set replaces configured faults.
+func (fi *FaultInjector) Set(f Faults) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.faults = f
+}
+
+// Get returns configured faults.
+func (fi *FaultInjector) Get() Faults {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	return fi.faults
+}
+
+func (fi *FaultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		var f Faults
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fi.Set(f)
+	case http.MethodDelete:
+		fi.Set(Faults{})
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fi.Get())
+}
+
+// delay sleeps for configured latency, if it's chosen to be injected.
+func (fi *FaultInjector) delay(ctx context.Context) {
+	f := fi.Get()
+	if f.Latency <= 0 || !chance(f.LatencyPercent) {
+		return
+	}
+	t := time.NewTimer(f.Latency)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// drop reports whether backend connection should be dropped.
+func (fi *FaultInjector) drop() bool { return chance(fi.Get().DropPercent) }
+
+// truncate returns r, possibly limited to a random number of bytes.
+func (fi *FaultInjector) truncate(r io.Reader) io.Reader {
+	f := fi.Get()
+	if !chance(f.TruncatePercent) {
+		return r
+	}
+	max := f.TruncateMax
+	if max <= 0 {
+		max = 1024
+	}
+	return io.LimitReader(r, rand.Int63n(max))
+}
+
+func chance(percent float64) bool { return percent > 0 && rand.Float64()*100 < percent }
@@ -0,0 +1,75 @@
+package uwsgi
+
+import (
+	"net"
+	"net/netip"
+)
+
+// GeoLocation describes geographical location of an IP address. Empty fields
+// mean location is unknown.
+type GeoLocation struct {
+	CountryCode string // ISO 3166-1 alpha-2 code, like "DE"
+	City        string // English city name
+}
+
+// GeoIP looks up location of IP addresses, see Proxy.GeoIP.
+type GeoIP interface {
+	Locate(netip.Addr) (GeoLocation, error)
+}
+
+// MaxMind returns GeoIP backed by MaxMind GeoIP2/GeoLite2 City or Country
+// database reader, like *maxminddb.Reader from the
+// github.com/oschwald/maxminddb-golang package:
+//
+//	db, err := maxminddb.Open("GeoLite2-City.mmdb")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer db.Close()
+//	p.GeoIP = uwsgi.MaxMind(db)
+func MaxMind(db interface {
+	Lookup(ip net.IP, result interface{}) error
+}) GeoIP {
+	return maxMind{db: db}
+}
+
+type maxMind struct {
+	db interface {
+		Lookup(ip net.IP, result interface{}) error
+	}
+}
+
+func (m maxMind) Locate(addr netip.Addr) (GeoLocation, error) {
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		City struct {
+			Names map[string]string `maxminddb:"names"`
+		} `maxminddb:"city"`
+	}
+	if err := m.db.Lookup(net.IP(addr.AsSlice()), &rec); err != nil {
+		return GeoLocation{}, err
+	}
+	return GeoLocation{CountryCode: rec.Country.ISOCode, City: rec.City.Names["en"]}, nil
+}
+
+// geoVars returns variables describing location of the client address,
+// like nginx geoip module does.
+func (p *Proxy) geoVars(addr netip.Addr) ([]Var, error) {
+	if !addr.IsValid() {
+		return nil, nil
+	}
+	loc, err := p.GeoIP.Locate(addr.Unmap())
+	if err != nil {
+		return nil, err
+	}
+	var vars []Var
+	if loc.CountryCode != "" {
+		vars = append(vars, Var{"GEOIP_COUNTRY_CODE", loc.CountryCode})
+	}
+	if loc.City != "" {
+		vars = append(vars, Var{"GEOIP_CITY", loc.City})
+	}
+	return vars, nil
+}
@@ -1,3 +1,13 @@
 module github.com/artyom/uwsgi
 
-go 1.12
+go 1.24.0
+
+require (
+	golang.org/x/crypto v0.43.0
+	golang.org/x/net v0.45.0
+)
+
+require (
+	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/text v0.30.0 // indirect
+)
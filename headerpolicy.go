@@ -0,0 +1,26 @@
+package uwsgi
+
+import "strings"
+
+// headerAllowed reports whether header with the given name matches any of
+// allow patterns (or allow is empty), and doesn't match any of deny
+// patterns. Patterns are case-insensitive header names, pattern ending with
+// "*" matches names by prefix.
+func headerAllowed(name string, allow, deny []string) bool {
+	return (len(allow) == 0 || matchHeader(name, allow)) && !matchHeader(name, deny)
+}
+
+func matchHeader(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package uwsgi
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// BackendStatus describes health of a backend, see Proxy.BackendStatus and
+// Balancer.BackendStatus.
+type BackendStatus struct {
+	Addr     string    `json:"addr"`             // backend address, empty for Proxy backend
+	Healthy  bool      `json:"healthy"`          // false if backend is ejected after failures
+	Fails    int       `json:"fails"`            // consecutive failures counted towards ejection
+	RetryAt  time.Time `json:"retryAt,omitzero"` // when ejected backend is used again
+	Conns    int       `json:"conns"`            // open connections, only tracked by Balancer
+	Disabled bool      `json:"disabled"`         // see Balancer.SetDisabled
+	Draining bool      `json:"draining"`         // backend is shutting down, see Balancer.PollStats
+}
+
+// errBackendDown is reported for requests rejected because backend is ejected
+// after failures, see Proxy.MaxFails.
+var errBackendDown = errors.New("backend is marked down after failures")
+
+// BackendStatus returns health of the backend as tracked by Proxy, see
+// MaxFails.
+func (p *Proxy) BackendStatus() BackendStatus {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := BackendStatus{Healthy: !now.Before(p.downUntil), Fails: p.fails}
+	if !st.Healthy {
+		st.RetryAt = p.downUntil
+	}
+	return st
+}
+
+// rejectDown replies with 503 Service Unavailable status if backend is
+// ejected after failures, and reports whether it did so.
+func (p *Proxy) rejectDown(w http.ResponseWriter, r *http.Request, res *Result) bool {
+	if p.MaxFails <= 0 {
+		return false
+	}
+	now := time.Now()
+	p.mu.Lock()
+	until := p.downUntil
+	p.mu.Unlock()
+	if !now.Before(until) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(until.Sub(now).Seconds()))))
+	p.replyError(w, r, res, http.StatusServiceUnavailable, "", errBackendDown)
+	return true
+}
+
+// backendResult records result of exchange with the backend over conn (nil if
+// connection failed), passing it to Balancer the connection came from.
+func (p *Proxy) backendResult(conn net.Conn, ok bool) {
+	if tc := asTracked(conn); tc != nil {
+		tc.report(ok)
+	}
+	if p.MaxFails <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok {
+		p.fails = 0
+		return
+	}
+	if p.fails++; p.fails >= p.MaxFails {
+		p.fails = 0
+		p.downUntil = time.Now().Add(p.failCooldown())
+	}
+}
+
+func (p *Proxy) failCooldown() time.Duration {
+	if p.FailCooldown > 0 {
+		return p.FailCooldown
+	}
+	return 10 * time.Second
+}
+
+// Ping connects to the backend with dial and sends it uwsgi ping packet
+// (modifier1 100), returning round-trip time of the exchange, including
+// connection setup. Backends speaking HTTP instead of uwsgi protocol are
+// reported as alive too. If ctx has no deadline, ping times out after a
+// second.
+func Ping(ctx context.Context, dial DialFunc) (time.Duration, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+	}
+	begin := time.Now()
+	conn, err := dial(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if _, err := probe(conn); err != nil {
+		return 0, err
+	}
+	return time.Since(begin), nil
+}
+
+// HealthCheck pings the backend (see Ping) every interval until ctx is
+// canceled, calling fn, if not nil, with results. Failed pings count towards
+// MaxFails, and successful ones bring ejected backend back into service
+// right away.
+func (p *Proxy) HealthCheck(ctx context.Context, interval time.Duration, fn func(rtt time.Duration, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rtt, err := Ping(ctx, p.DialContext)
+		if ctx.Err() != nil {
+			return
+		}
+		p.backendResult(nil, err == nil)
+		if err == nil {
+			p.mu.Lock()
+			p.downUntil = time.Time{}
+			p.mu.Unlock()
+		}
+		if fn != nil {
+			fn(rtt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package uwsgi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HostApp returns function usable as Proxy.VarMapper for mass-hosting setups
+// where single uWSGI instance loads per-domain applications on demand (see
+// uWSGI "dynamic apps" documentation). It sets UWSGI_APPID variable to the
+// request host name, and UWSGI_SCRIPT and UWSGI_MODULE variables from
+// templates, unless they're empty.
+//
+// In templates, "{host}" is replaced with the host name, and "{name}" with
+// the host name having all characters other than ASCII letters and digits
+// replaced with underscores, so it's usable as Python module name:
+//
+//	p.VarMapper = uwsgi.HostApp("", "apps.{name}:application")
+//
+// Host name is lower-cased and has port removed. Requests with host names
+// that are not valid DNS names (e.g. IP addresses in brackets or names with
+// path separators) get no variables set.
+func HostApp(script, module string) func(*http.Request) []Var {
+	return func(r *http.Request) []Var {
+		host := hostname(r.Host)
+		if !validHostname(host) {
+			return nil
+		}
+		vars := []Var{{"UWSGI_APPID", host}}
+		expand := func(tmpl string) string {
+			return strings.NewReplacer("{host}", host, "{name}", hostIdent(host)).Replace(tmpl)
+		}
+		if script != "" {
+			vars = append(vars, Var{"UWSGI_SCRIPT", expand(script)})
+		}
+		if module != "" {
+			vars = append(vars, Var{"UWSGI_MODULE", expand(module)})
+		}
+		return vars
+	}
+}
+
+// validHostname reports whether s consists of non-empty dot-separated labels
+// of ASCII letters, digits, and hyphens.
+func validHostname(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hostIdent returns host with characters other than ASCII letters and digits
+// replaced with underscores.
+func hostIdent(host string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			return c
+		}
+		return '_'
+	}, host)
+}
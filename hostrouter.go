@@ -0,0 +1,191 @@
+package uwsgi
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostRouter is a http.Handler routing requests to backends resolved
+// dynamically from the Host header, which is useful for mass-hosting setups
+// like one uWSGI Emperor vassal per domain.
+//
+// Resolved backends are kept in a bounded LRU cache, hosts for which Resolve
+// returned ErrUnknownHost are cached for NegativeTTL and get 421 Misdirected
+// Request reply.
+type HostRouter struct {
+	// Resolve returns dialer connecting to the backend for the given host,
+	// which is lower-cased and has port and trailing dot removed. It must
+	// return ErrUnknownHost (possibly wrapped) for hosts that are not
+	// served; other errors are not cached and result in 502 Bad Gateway
+	// reply, unless they're *StatusError.
+	Resolve func(host string) (DialFunc, error)
+
+	// NewHandler, if set, creates handler serving requests for the resolved
+	// host; if nil, Proxy with the resolved dialer is used. Handlers dropped
+	// from the cache get their CloseIdleConnections method called, if they
+	// have one, like Proxy does.
+	NewHandler func(host string, dial DialFunc) http.Handler
+
+	// CacheSize is the maximum number of cached hosts, both resolved and
+	// unknown. If zero, 1024 is used.
+	CacheSize int
+
+	// NegativeTTL is how long unknown hosts are cached. If zero, one minute
+	// is used.
+	NegativeTTL time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // of *hostEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+// ErrUnknownHost should be returned by HostRouter.Resolve for hosts that are
+// not served.
+var ErrUnknownHost = errors.New("unknown host")
+
+type hostEntry struct {
+	host    string
+	handler http.Handler // nil for unknown hosts
+	expires time.Time    // only set for unknown hosts
+}
+
+func (hr *HostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := hostname(r.Host)
+	if host == "" {
+		http.Error(w, "Host header required", http.StatusBadRequest)
+		return
+	}
+	h, ok := hr.lookup(host)
+	cache := "miss"
+	if ok {
+		cache = "hit"
+	}
+	r = WithTrace(WithTrace(r, "host", host), "cache", cache)
+	if !ok {
+		dial, err := hr.Resolve(host)
+		switch {
+		case errors.Is(err, ErrUnknownHost):
+			hr.store(&hostEntry{host: host, expires: time.Now().Add(hr.negativeTTL())})
+		case err != nil:
+			logFunc(r)("uwsgi resolve %q: %v", host, err)
+			code, text := errorStatus(err, http.StatusBadGateway)
+			http.Error(w, text, code)
+			return
+		default:
+			if hr.NewHandler != nil {
+				h = hr.NewHandler(host, dial)
+			} else {
+				h = &Proxy{DialContext: dial}
+			}
+			hr.store(&hostEntry{host: host, handler: h})
+		}
+	}
+	if h == nil {
+		http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// Forget removes host from the cache, so it's resolved again on the next
+// request.
+func (hr *HostRouter) Forget(host string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if el, ok := hr.entries[host]; ok {
+		hr.lru.Remove(el)
+		delete(hr.entries, host)
+		closeIdle(el.Value.(*hostEntry).handler)
+	}
+}
+
+// Flush removes all hosts from the cache.
+func (hr *HostRouter) Flush() {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if hr.lru != nil {
+		for el := hr.lru.Front(); el != nil; el = el.Next() {
+			closeIdle(el.Value.(*hostEntry).handler)
+		}
+		hr.lru.Init()
+	}
+	clear(hr.entries)
+}
+
+// lookup returns cached handler for the host; ok is false if host is not
+// cached, handler is nil if host is known to be unknown.
+func (hr *HostRouter) lookup(host string) (h http.Handler, ok bool) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	el, ok := hr.entries[host]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*hostEntry)
+	if e.handler == nil && time.Now().After(e.expires) {
+		hr.lru.Remove(el)
+		delete(hr.entries, host)
+		return nil, false
+	}
+	hr.lru.MoveToFront(el)
+	return e.handler, true
+}
+
+func (hr *HostRouter) store(e *hostEntry) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if hr.entries == nil {
+		hr.entries = make(map[string]*list.Element)
+		hr.lru = list.New()
+	}
+	if el, ok := hr.entries[e.host]; ok {
+		if old := el.Value.(*hostEntry); old.handler != e.handler {
+			closeIdle(old.handler)
+		}
+		el.Value = e
+		hr.lru.MoveToFront(el)
+		return
+	}
+	hr.entries[e.host] = hr.lru.PushFront(e)
+	for hr.lru.Len() > hr.cacheSize() {
+		el := hr.lru.Back()
+		hr.lru.Remove(el)
+		delete(hr.entries, el.Value.(*hostEntry).host)
+		closeIdle(el.Value.(*hostEntry).handler)
+	}
+}
+
+// closeIdle closes idle backend connections of handler that is no longer
+// used, if it has CloseIdleConnections method.
+func closeIdle(h http.Handler) {
+	if c, ok := h.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func (hr *HostRouter) cacheSize() int {
+	if hr.CacheSize > 0 {
+		return hr.CacheSize
+	}
+	return 1024
+}
+
+func (hr *HostRouter) negativeTTL() time.Duration {
+	if hr.NegativeTTL > 0 {
+		return hr.NegativeTTL
+	}
+	return time.Minute
+}
+
+// hostname returns lower-cased host without port and trailing dot.
+func hostname(host string) string {
+	host = strings.ToLower(host)
+	if i := strings.LastIndexByte(host, ':'); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(host, ".")
+}
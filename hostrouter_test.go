@@ -0,0 +1,45 @@
+package uwsgi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostRouterCloseIdle(t *testing.T) {
+	proxies := make(map[string]*Proxy)
+	hr := &HostRouter{
+		CacheSize: 1,
+		Resolve: func(host string) (DialFunc, error) {
+			b := &testBackend{handle: okResponse, keepAlive: true}
+			return b.dial, nil
+		},
+		NewHandler: func(host string, dial DialFunc) http.Handler {
+			p := &Proxy{DialContext: dial, MaxIdleConns: 1}
+			proxies[host] = p
+			return p
+		},
+	}
+	send := func(host string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		hr.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	send("a.example.com")
+	if idle := proxies["a.example.com"].PoolStats().Idle; idle != 1 {
+		t.Fatalf("got %d idle connections, want 1", idle)
+	}
+	send("b.example.com") // evicts a.example.com
+	if idle := proxies["a.example.com"].PoolStats().Idle; idle != 0 {
+		t.Fatalf("evicted Proxy has %d idle connections, want 0", idle)
+	}
+	hr.Forget("b.example.com")
+	if idle := proxies["b.example.com"].PoolStats().Idle; idle != 0 {
+		t.Fatalf("forgotten Proxy has %d idle connections, want 0", idle)
+	}
+}
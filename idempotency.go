@@ -0,0 +1,234 @@
+package uwsgi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Idempotency deduplicates POST requests carrying Idempotency-Key header: the
+// response to the first request with the given key is cached for TTL, and
+// replayed to retries of that request with Idempotent-Replayed: true header
+// added, instead of passing them to the backend again. Retries arriving while
+// the first request is still being processed get 409 Conflict reply, and
+// requests reusing the key with a different body get 422 Unprocessable
+// Entity reply.
+//
+// Keys are scoped by caller identity (see Identity) and request path.
+// Responses with 5xx status or with bodies larger than MaxBodySize are not
+// cached.
+//
+// Use Idempotency.Handler to wrap handler being protected.
+type Idempotency struct {
+	TTL         time.Duration // time to keep responses, 1 hour if zero
+	MaxBodySize int64         // max size of cached response body, 1 MiB if zero
+
+	// Identity, if set, returns identity of the caller, like user ID
+	// established by authentication middleware, so that callers using the
+	// same key don't get each other's responses. If nil, Authorization
+	// header is used; requests without it share the scope.
+	Identity func(*http.Request) string
+
+	mu        sync.Mutex
+	entries   map[string]*idemEntry
+	lastSweep time.Time
+}
+
+type idemEntry struct {
+	done     bool
+	expires  time.Time
+	bodyHash string // SHA-256 of the request body
+	status   int
+	header   http.Header
+	body     []byte
+}
+
+// Handler returns handler that deduplicates requests passed to h.
+func (c *Idempotency) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != http.MethodPost {
+			h.ServeHTTP(w, r)
+			return
+		}
+		key = c.scopedKey(r, key)
+		now := time.Now()
+		c.mu.Lock()
+		c.sweep(now)
+		if e, ok := c.entries[key]; ok && !(e.done && now.After(e.expires)) {
+			snap := *e // entry is updated under c.mu once response is cached
+			c.mu.Unlock()
+			e = &snap
+			if !e.done {
+				http.Error(w, "Request with the same Idempotency-Key is being processed",
+					http.StatusConflict)
+				return
+			}
+			sum, err := hashBody(r.Body)
+			if err != nil {
+				http.Error(w, "Request body read failed", http.StatusBadRequest)
+				return
+			}
+			if sum != e.bodyHash {
+				http.Error(w, "Idempotency-Key is already used with a different request body",
+					http.StatusUnprocessableEntity)
+				return
+			}
+			wh := w.Header()
+			for k, v := range e.header {
+				wh[k] = v
+			}
+			wh.Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+		e := &idemEntry{}
+		c.entries[key] = e
+		c.mu.Unlock()
+
+		cached := false
+		defer func() {
+			if !cached {
+				c.mu.Lock()
+				delete(c.entries, key)
+				c.mu.Unlock()
+			}
+		}()
+		body := &hashingBody{ReadCloser: r.Body, h: sha256.New()}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Body = body
+		rw := &recordingWriter{statusWriter: statusWriter{ResponseWriter: w}, limit: c.maxBodySize()}
+		h.ServeHTTP(rw, r2)
+		if rw.status == 0 || rw.status >= 500 || rw.overflow {
+			return
+		}
+		// hash the rest of the body handler didn't read
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return
+		}
+		header := w.Header().Clone()
+		header.Set("Content-Length", strconv.Itoa(rw.buf.Len()))
+		header.Del("Date")
+		c.mu.Lock()
+		*e = idemEntry{
+			done:     true,
+			expires:  time.Now().Add(c.ttl()),
+			bodyHash: hex.EncodeToString(body.h.Sum(nil)),
+			status:   rw.status,
+			header:   header,
+			body:     rw.buf.Bytes(),
+		}
+		c.mu.Unlock()
+		cached = true
+	})
+}
+
+// Flush removes all cached responses.
+func (c *Idempotency) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.done {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// scopedKey returns cache key for request r with the given Idempotency-Key
+// header value, scoped by caller identity and request path. It's hashed so
+// that credentials are not kept in memory.
+func (c *Idempotency) scopedKey(r *http.Request, key string) string {
+	var id string
+	if c.Identity != nil {
+		id = c.Identity(r)
+	} else {
+		id = r.Header.Get("Authorization")
+	}
+	sum := sha256.Sum256([]byte(id + "\x00" + key + "\x00" + r.URL.Path))
+	return string(sum[:])
+}
+
+// hashBody returns hex-encoded SHA-256 of the data read from r until EOF.
+func hashBody(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashingBody is a request body computing hash of the data read from it.
+// Closing it is a no-op, so that the rest of the body can be hashed after
+// handler is done.
+type hashingBody struct {
+	io.ReadCloser
+	h hash.Hash
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+	return n, err
+}
+
+func (b *hashingBody) Close() error { return nil }
+
+// sweep removes expired entries; it must be called with c.mu held.
+func (c *Idempotency) sweep(now time.Time) {
+	if c.entries == nil {
+		c.entries = make(map[string]*idemEntry)
+	}
+	if now.Sub(c.lastSweep) < c.ttl()/10 {
+		return
+	}
+	c.lastSweep = now
+	for k, e := range c.entries {
+		if e.done && now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *Idempotency) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return time.Hour
+}
+
+func (c *Idempotency) maxBodySize() int64 {
+	if c.MaxBodySize > 0 {
+		return c.MaxBodySize
+	}
+	return 1 << 20
+}
+
+// recordingWriter is a http.ResponseWriter that keeps a copy of response body
+// up to the limit.
+type recordingWriter struct {
+	statusWriter
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	n, err := w.statusWriter.Write(b)
+	if !w.overflow {
+		if int64(w.buf.Len()+n) > w.limit {
+			w.overflow = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(b[:n])
+		}
+	}
+	return n, err
+}
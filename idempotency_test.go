@@ -0,0 +1,113 @@
+package uwsgi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIdempotency(t *testing.T) {
+	var calls int
+	c := &Idempotency{}
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		b, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Header.Get("Authorization")+" "+string(b))
+	}))
+	do := func(auth, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", "k1")
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	for _, tc := range []struct {
+		auth, body string
+		code       int
+		replayed   bool
+		calls      int
+	}{
+		{"alice", "a", http.StatusOK, false, 1},
+		{"alice", "a", http.StatusOK, true, 1},
+		{"alice", "b", http.StatusUnprocessableEntity, false, 1},
+		{"bob", "a", http.StatusOK, false, 2}, // other caller, same key
+	} {
+		w := do(tc.auth, tc.body)
+		if w.Code != tc.code {
+			t.Fatalf("%s %q: got status %d, want %d", tc.auth, tc.body, w.Code, tc.code)
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tc.replayed {
+			t.Fatalf("%s %q: replayed = %v, want %v", tc.auth, tc.body, replayed, tc.replayed)
+		}
+		if tc.code == http.StatusOK && w.Body.String() != tc.auth+" "+tc.body {
+			t.Fatalf("%s %q: got body %q", tc.auth, tc.body, w.Body)
+		}
+		if calls != tc.calls {
+			t.Fatalf("%s %q: handler called %d times, want %d", tc.auth, tc.body, calls, tc.calls)
+		}
+	}
+}
+
+func TestIdempotencyConcurrent(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	c := &Idempotency{}
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		w.Header().Set("X-Order", "1")
+		io.WriteString(w, "created")
+	}))
+	do := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("a"))
+		r.Header.Set("Idempotency-Key", "k1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- do() }()
+	<-started
+	// retries racing with the first request in flight and with caching of
+	// its response
+	var wg sync.WaitGroup
+	codes := make(chan int, 16)
+	for i := range 16 {
+		if i == 8 {
+			close(release)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := do()
+			if w.Code == http.StatusOK && (w.Body.String() != "created" || w.Header().Get("X-Order") != "1") {
+				t.Errorf("replayed response %q with header %v", w.Body, w.Header())
+			}
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	if w := <-first; w.Code != http.StatusOK {
+		t.Fatalf("first request: got status %d", w.Code)
+	}
+	for code := range codes {
+		if code != http.StatusOK && code != http.StatusConflict {
+			t.Fatalf("retry: got status %d, want 200 or 409", code)
+		}
+	}
+	if w := do(); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry after completion: got status %d, headers %v", w.Code, w.Header())
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("handler called %d times, want 1", n)
+	}
+}
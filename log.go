@@ -0,0 +1,57 @@
+package uwsgi
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// LogLevel controls verbosity of Proxy logging, see Proxy.SetLogLevel.
+type LogLevel int32
+
+const (
+	LogOff   LogLevel = iota - 1 // nothing is logged
+	LogError                     // errors are logged, the default
+	LogDebug                     // errors and a line per request are logged
+)
+
+var logLevelNames = map[LogLevel]string{LogOff: "off", LogError: "error", LogDebug: "debug"}
+
+func (l LogLevel) String() string {
+	if s, ok := logLevelNames[l]; ok {
+		return s
+	}
+	return fmt.Sprintf("LogLevel(%d)", int32(l))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (l LogLevel) MarshalText() ([]byte, error) { return []byte(l.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting "off",
+// "error", and "debug".
+func (l *LogLevel) UnmarshalText(b []byte) error {
+	for level, name := range logLevelNames {
+		if string(b) == name {
+			*l = level
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q", b)
+}
+
+// SetLogLevel changes verbosity of Proxy logging, it can be called while
+// Proxy serves requests. With LogDebug level, each request is logged with
+// its status, backend address, and timings.
+func (p *Proxy) SetLogLevel(l LogLevel) { p.logLevel.Store(int32(l)) }
+
+// LogLevel returns verbosity of Proxy logging, see SetLogLevel.
+func (p *Proxy) LogLevel() LogLevel { return LogLevel(p.logLevel.Load()) }
+
+// logResult logs how request was handled if log level is LogDebug.
+func (p *Proxy) logResult(r *http.Request, res Result) {
+	if p.LogLevel() < LogDebug {
+		return
+	}
+	p.logFunc(r)("uwsgi %s %s: status %d, backend %q, phase %v, wait %v, dial %v, header %v, total %v",
+		r.Method, r.URL.RequestURI(), res.Code(), res.Backend, res.Phase,
+		res.Wait, res.Dial, res.Header, res.Total)
+}
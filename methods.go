@@ -0,0 +1,113 @@
+package uwsgi
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// MethodPolicy defines how Proxy handles requests with particular methods,
+// see Proxy.OptionsAsterisk, Proxy.Trace, and Proxy.UnknownMethods.
+type MethodPolicy int
+
+const (
+	// MethodPass passes request to the backend, the default.
+	MethodPass MethodPolicy = iota
+	// MethodReject rejects request with 405 Method Not Allowed status, or
+	// 501 Not Implemented status for unknown methods.
+	MethodReject
+	// MethodAnswer makes Proxy answer the request itself: OPTIONS *
+	// requests get an empty response with Allow header, TRACE requests get
+	// the request echoed back as message/http (with credentials removed).
+	// For unknown methods it is the same as MethodReject.
+	MethodAnswer
+)
+
+// applyMethodPolicy handles request according to configured method policy
+// and reports whether request was handled without contacting the backend.
+func (p *Proxy) applyMethodPolicy(w http.ResponseWriter, r *http.Request, res *Result) bool {
+	if !p.methodAllowed(r.Method) {
+		w.Header().Set("Allow", p.allow())
+		p.replyError(w, r, res, http.StatusMethodNotAllowed, "", errMethodNotAllowed)
+		return true
+	}
+	var policy MethodPolicy
+	switch {
+	case r.Method == http.MethodOptions && r.RequestURI == "*":
+		policy = p.OptionsAsterisk
+	case r.Method == http.MethodTrace:
+		policy = p.Trace
+	case !knownMethods[r.Method]:
+		policy = p.UnknownMethods
+		if policy != MethodPass {
+			p.replyError(w, r, res, http.StatusNotImplemented, "", errUnknownMethod)
+			return true
+		}
+	}
+	switch policy {
+	case MethodReject:
+		w.Header().Set("Allow", p.allow())
+		p.replyError(w, r, res, http.StatusMethodNotAllowed, "", errMethodNotAllowed)
+		return true
+	case MethodAnswer:
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", p.allow())
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+			return true
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Header = r.Header.Clone()
+		for _, k := range []string{"Authorization", "Proxy-Authorization", "Cookie"} {
+			r2.Header.Del(k)
+		}
+		b, err := httputil.DumpRequest(r2, false)
+		if err != nil {
+			p.replyError(w, r, res, http.StatusBadRequest, "", err)
+			return true
+		}
+		w.Header().Set("Content-Type", "message/http")
+		w.Write(b)
+		return true
+	}
+	return false
+}
+
+// methodAllowed reports whether method is in p.AllowedMethods, or the list is
+// empty.
+func (p *Proxy) methodAllowed(method string) bool {
+	if len(p.AllowedMethods) == 0 {
+		return true
+	}
+	for _, m := range p.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allow returns the value of Allow header in responses generated by Proxy.
+func (p *Proxy) allow() string {
+	if len(p.AllowedMethods) != 0 {
+		return strings.Join(p.AllowedMethods, ", ")
+	}
+	return allowedMethods
+}
+
+// allowedMethods is the default value of Allow header in responses generated
+// by Proxy.
+const allowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
@@ -0,0 +1,111 @@
+package uwsgi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMethodPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		proxy       *Proxy
+		method, uri string
+		code        int
+		allow       string // expected Allow header
+		err         error  // expected Result.Err, nil if not checked
+	}{
+		{
+			name:   "not in AllowedMethods",
+			proxy:  &Proxy{AllowedMethods: []string{"GET", "HEAD"}},
+			method: "POST", uri: "/",
+			code: http.StatusMethodNotAllowed, allow: "GET, HEAD", err: errMethodNotAllowed,
+		},
+		{
+			name:   "unknown method rejected",
+			proxy:  &Proxy{UnknownMethods: MethodReject},
+			method: "PROPFIND", uri: "/",
+			code: http.StatusNotImplemented, err: errUnknownMethod,
+		},
+		{
+			name:   "TRACE rejected",
+			proxy:  &Proxy{Trace: MethodReject},
+			method: "TRACE", uri: "/",
+			code: http.StatusMethodNotAllowed, allow: allowedMethods, err: errMethodNotAllowed,
+		},
+		{
+			name:   "OPTIONS * answered",
+			proxy:  &Proxy{OptionsAsterisk: MethodAnswer},
+			method: "OPTIONS", uri: "*",
+			code: http.StatusOK, allow: allowedMethods,
+		},
+		{
+			name:   "passed to backend",
+			proxy:  &Proxy{AllowedMethods: []string{"GET"}, Trace: MethodReject},
+			method: "GET", uri: "/",
+			code: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &testBackend{handle: okResponse}
+			tc.proxy.DialContext = b.dial
+			tc.proxy.JSONErrors = true
+			r := httptest.NewRequest(tc.method, "/", nil)
+			r.RequestURI = tc.uri
+			r.Header.Set("X-Request-Id", "req1")
+			w := httptest.NewRecorder()
+			res := tc.proxy.ServeHTTPResult(w, r)
+			if w.Code != tc.code {
+				t.Fatalf("got status %d, want %d", w.Code, tc.code)
+			}
+			if got := w.Header().Get("Allow"); got != tc.allow {
+				t.Fatalf("got Allow %q, want %q", got, tc.allow)
+			}
+			if tc.method != "GET" && b.dials.Load() != 0 {
+				t.Fatal("request was passed to the backend")
+			}
+			if tc.err == nil {
+				return
+			}
+			if !errors.Is(res.Err, tc.err) {
+				t.Fatalf("got error %v, want %v", res.Err, tc.err)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Fatalf("got Content-Type %q", ct)
+			}
+			var problem struct {
+				Title         string `json:"title"`
+				Status        int    `json:"status"`
+				CorrelationID string `json:"correlation_id"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Status != tc.code || problem.Title != http.StatusText(tc.code) || problem.CorrelationID != "req1" {
+				t.Fatalf("got problem %+v", problem)
+			}
+		})
+	}
+}
+
+func TestTraceAnswer(t *testing.T) {
+	p := &Proxy{Trace: MethodAnswer}
+	r := httptest.NewRequest("TRACE", "/path", nil)
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("X-Debug", "1")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "message/http" {
+		t.Fatalf("got status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "TRACE /path HTTP/1.1\r\n") || !strings.Contains(body, "X-Debug: 1") {
+		t.Fatalf("unexpected body %q", body)
+	}
+	if strings.Contains(body, "secret") {
+		t.Fatalf("body contains credentials: %q", body)
+	}
+}
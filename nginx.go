@@ -0,0 +1,42 @@
+package uwsgi
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// nginxVars returns variables as set by nginx with its stock uwsgi_params
+// file, see Proxy.NginxCompat.
+func (p *Proxy) nginxVars(r *http.Request, method, reqURI, pathInfo string, contentLength int64) []Var {
+	var contentLengthVar string
+	if contentLength > 0 || r.Header.Get("Content-Length") != "" {
+		contentLengthVar = strconv.FormatInt(contentLength, 10)
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	vars := []Var{
+		{"QUERY_STRING", r.URL.RawQuery},
+		{"REQUEST_METHOD", method},
+		{"CONTENT_TYPE", r.Header.Get("Content-Type")},
+		{"CONTENT_LENGTH", contentLengthVar},
+		{"REQUEST_URI", reqURI},
+		{"PATH_INFO", pathInfo},
+		{"DOCUMENT_ROOT", p.DocumentRoot},
+		{"SERVER_PROTOCOL", r.Proto},
+		{"REQUEST_SCHEME", scheme},
+	}
+	if r.TLS != nil {
+		vars = append(vars, Var{"HTTPS", "on"})
+	}
+	addr, port := p.remoteAddr(r)
+	vars = append(vars, Var{"REMOTE_ADDR", addr}, Var{"REMOTE_PORT", port})
+	serverAddr, serverPort := localAddr(r)
+	return append(vars,
+		Var{"SERVER_PORT", serverPort},
+		Var{"SERVER_NAME", hostname(r.Host)},
+		Var{"SERVER_ADDR", serverAddr},
+		Var{"HTTP_HOST", r.Host}, // net/http removes it from r.Header
+	)
+}
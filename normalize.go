@@ -0,0 +1,34 @@
+package uwsgi
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// normalizePath returns u.Path with duplicate slashes collapsed and dot
+// segments resolved, keeping trailing slash. It reports false if escaped
+// form of path contains encoded slashes, backslashes, or encoded dot
+// segments, which are commonly used for path traversal.
+func normalizePath(u *url.URL) (string, bool) {
+	if !strings.HasPrefix(u.Path, "/") {
+		return u.Path, true
+	}
+	for _, seg := range strings.Split(u.EscapedPath(), "/") {
+		if !strings.Contains(seg, "%") {
+			continue
+		}
+		s := strings.ToLower(seg)
+		if strings.Contains(s, "%2f") || strings.Contains(s, "%5c") {
+			return "", false
+		}
+		if dec, err := url.PathUnescape(seg); err != nil || dec == "." || dec == ".." {
+			return "", false
+		}
+	}
+	clean := path.Clean(u.Path)
+	if strings.HasSuffix(u.Path, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean, true
+}
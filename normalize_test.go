@@ -0,0 +1,57 @@
+package uwsgi
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	for _, tc := range []struct {
+		target string // escaped request path
+		want   string
+		ok     bool
+	}{
+		{"/a/b", "/a/b", true},
+		{"/a/b/", "/a/b/", true},
+		{"//a/../b", "/b", true},
+		{"/a/./b/../c/", "/a/c/", true},
+		{"/a/..", "/", true},
+		{"/../../etc/passwd", "/etc/passwd", true},
+		{"/a/%2e%2e/b", "", false},
+		{"/a/%2E%2e/b", "", false},
+		{"/a/.%2e/b", "", false},
+		{"/a/%2e/b", "", false},
+		{"/a%2Fb", "", false},
+		{"/a%2fb", "", false},
+		{"/a%5cb", "", false},
+		{"/a%5C..%5Cb", "", false},
+		{"/a%20b", "/a b", true},
+		{"/%252e%252e/x", "/%2e%2e/x", true}, // double encoded, decoded once
+		{"*", "*", true},
+	} {
+		u, err := url.Parse(tc.target)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.target, err)
+		}
+		got, ok := normalizePath(u)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%q: got %q, %t, want %q, %t", tc.target, got, ok, tc.want, tc.ok)
+		}
+	}
+	// invalid escape from a client is taken literally
+	u := &url.URL{Path: "/a%zz/../b", RawPath: "/a%zz/../b"}
+	if got, ok := normalizePath(u); got != "/b" || !ok {
+		t.Errorf("invalid escape: got %q, %t, want %q, true", got, ok, "/b")
+	}
+}
+
+func TestValidatePassthrough(t *testing.T) {
+	p := &Proxy{DialContext: (&testBackend{}).dial, Passthrough: true, NormalizePath: true}
+	if err := p.Validate(); err == nil {
+		t.Fatal("Validate accepted NormalizePath with Passthrough")
+	}
+	p.NormalizePath = false
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
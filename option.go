@@ -0,0 +1,36 @@
+package uwsgi
+
+import "log"
+
+// Option configures Proxy created with NewProxy. Since Option is a plain
+// function, any setting not covered by helpers below can be applied with
+// a function literal:
+//
+//	p, err := uwsgi.NewProxy(
+//		uwsgi.Backend(uwsgi.Dial("unix", "/path/to/uwsgi.socket")),
+//		func(p *uwsgi.Proxy) { p.Protocol = uwsgi.ProtocolAuto },
+//	)
+type Option func(*Proxy)
+
+// NewProxy returns Proxy configured with given options, and validates its
+// configuration, see Proxy.Validate.
+func NewProxy(opts ...Option) (*Proxy, error) {
+	p := new(Proxy)
+	for _, opt := range opts {
+		opt(p)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Backend sets Proxy.DialContext to dial.
+func Backend(dial DialFunc) Option {
+	return func(p *Proxy) { p.DialContext = dial }
+}
+
+// ErrorLogger sets Proxy.ErrorLog to l.
+func ErrorLogger(l *log.Logger) Option {
+	return func(p *Proxy) { p.ErrorLog = l }
+}
@@ -0,0 +1,41 @@
+package uwsgi
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// overrideMethod returns method requested by X-HTTP-Method-Override header or
+// by _method form field of the POST request, if it's in p.MethodOverride
+// list; otherwise it returns r.Method. If the form had to be read, returned
+// reader replays the request body.
+func (p *Proxy) overrideMethod(r *http.Request) (string, io.Reader, error) {
+	if r.Method != http.MethodPost {
+		return r.Method, r.Body, nil
+	}
+	method := r.Header.Get("X-HTTP-Method-Override")
+	var body io.Reader = r.Body
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); method == "" &&
+		ct == "application/x-www-form-urlencoded" &&
+		r.ContentLength > 0 && r.ContentLength <= p.spoolMemory() {
+		b, err := io.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+		if err != nil {
+			return "", nil, err
+		}
+		body = bytes.NewReader(b)
+		if form, err := url.ParseQuery(string(b)); err == nil {
+			method = form.Get("_method")
+		}
+	}
+	method = strings.ToUpper(method)
+	for _, m := range p.MethodOverride {
+		if method == m {
+			return method, body, nil
+		}
+	}
+	return r.Method, body, nil
+}
@@ -0,0 +1,254 @@
+package uwsgi
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connPool keeps idle backend connections for reuse and limits the number of
+// connections in use, see Proxy.MaxIdleConns and Proxy.MaxConns.
+type connPool struct {
+	limit limiter // of connections in use, if Proxy.MaxConns is set
+
+	hits, misses atomic.Int64 // see PoolStats
+
+	mu    sync.Mutex
+	idle  []idleConn  // most recently used last
+	timer *time.Timer // closes expired connections, if any are idle
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// getConn returns connection to the backend, reusing an idle one if
+// possible. If MaxConns connections are in use, it waits for one to be
+// released; waiting requests are served in order of priority. It returns
+// time spent waiting. Connection must be released with putConn.
+func (p *Proxy) getConn(ctx context.Context, priority int) (net.Conn, time.Duration, error) {
+	var wait time.Duration
+	if p.MaxConns > 0 {
+		begin := time.Now()
+		err := p.acquireSlot(ctx, priority)
+		if wait = time.Since(begin); err != nil {
+			return nil, wait, err
+		}
+	}
+	if p.RetryBudget != nil {
+		p.RetryBudget.Deposit()
+	}
+	for {
+		conn := p.pool.take(p.idleConnTimeout(), func(conn net.Conn) bool {
+			tc := asTracked(conn)
+			return tc == nil || tc.affine(ctx)
+		})
+		if conn == nil {
+			break
+		}
+		if connAlive(conn) && !staleSocket(conn) && !p.retired(conn) {
+			p.pool.hits.Add(1)
+			return conn, wait, nil
+		}
+		conn.Close()
+	}
+	p.pool.misses.Add(1)
+	conn, err := p.dial(ctx)
+	if err != nil && p.MaxConns > 0 {
+		p.pool.limit.release()
+	}
+	return conn, wait, err
+}
+
+// acquireSlot takes one of MaxConns connection slots, waiting for it for up
+// to MaxConnWait if it's set; see ConnWaitOverflow.
+func (p *Proxy) acquireSlot(ctx context.Context, priority int) error {
+	wctx := ctx
+	if p.MaxConnWait > 0 {
+		var cancel context.CancelFunc
+		wctx, cancel = context.WithTimeoutCause(ctx, p.MaxConnWait, errConnWait)
+		defer cancel()
+	}
+	err := p.pool.limit.acquire(wctx, p.MaxConns, p.MaxQueue, priority)
+	if err == nil || ctx.Err() != nil || context.Cause(wctx) != errConnWait {
+		return err
+	}
+	if !p.ConnWaitOverflow {
+		return errConnWait
+	}
+	p.pool.limit.overflow()
+	return nil
+}
+
+// dial makes a new connection to the backend, retrying errors as
+// DialErrors policies allow.
+func (p *Proxy) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := retryDial(ctx, p.DialContext, 0, time.Second, p.RetryBudget,
+		func(err error) bool { return p.dialPolicy(err).Retry })
+	if err != nil || p.MaxIdleConns <= 0 {
+		return conn, err
+	}
+	pc := &pooledConn{Conn: conn, created: time.Now()}
+	// remember which socket file connection was made to, see staleSocket
+	if addr, ok := conn.RemoteAddr().(*net.UnixAddr); ok && addr.Name != "" && addr.Name[0] != '@' {
+		if fi, err := os.Stat(addr.Name); err == nil {
+			pc.path, pc.file = addr.Name, fi
+		}
+	}
+	return pc, nil
+}
+
+// pooledConn is a backend connection that may be reused.
+type pooledConn struct {
+	net.Conn
+	created  time.Time
+	requests int // number of requests served, see Proxy.MaxConnRequests
+
+	// unix socket connection was made to, and the file it was at the
+	// time, if any
+	path string
+	file os.FileInfo
+}
+
+// NetConn returns the underlying connection.
+func (c *pooledConn) NetConn() net.Conn { return c.Conn }
+
+// staleSocket reports whether conn was made to unix socket file which has
+// since been removed or replaced by another one, so that new connections go
+// elsewhere.
+func staleSocket(conn net.Conn) bool {
+	c, ok := conn.(*pooledConn)
+	if !ok || c.file == nil {
+		return false
+	}
+	fi, err := os.Stat(c.path)
+	return err != nil || !os.SameFile(fi, c.file)
+}
+
+// retired reports whether conn has reached MaxConnAge or MaxConnRequests.
+func (p *Proxy) retired(conn net.Conn) bool {
+	c, ok := conn.(*pooledConn)
+	if !ok {
+		return false
+	}
+	return (p.MaxConnAge > 0 && time.Since(c.created) >= p.MaxConnAge) ||
+		(p.MaxConnRequests > 0 && c.requests >= p.MaxConnRequests)
+}
+
+// putConn releases connection obtained with getConn. If reuse is true, it's
+// kept for reuse while pool has room, otherwise it's closed.
+func (p *Proxy) putConn(conn net.Conn, reuse bool) {
+	if p.MaxConns > 0 {
+		defer p.pool.limit.release()
+	}
+	if c, ok := conn.(*pooledConn); ok {
+		c.requests++
+	}
+	if !reuse || p.MaxIdleConns <= 0 || p.isDraining() || p.retired(conn) ||
+		conn.SetDeadline(time.Time{}) != nil {
+		conn.Close()
+		return
+	}
+	pl := &p.pool
+	now := time.Now()
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	timeout := p.idleConnTimeout()
+	pl.closeExpired(now, timeout)
+	if len(pl.idle) >= p.MaxIdleConns {
+		pl.idle[0].conn.Close()
+		pl.idle = append(pl.idle[:0], pl.idle[1:]...)
+	}
+	pl.idle = append(pl.idle, idleConn{conn: conn, since: now})
+	if pl.timer == nil {
+		// close connections expiring while no requests come, e.g. after
+		// Proxy is dropped from HostRouter
+		pl.timer = time.AfterFunc(timeout, func() { pl.expire(timeout) })
+	}
+}
+
+// expire closes connections idle for longer than timeout, and schedules
+// itself to run once the oldest of the remaining ones expires.
+func (pl *connPool) expire(timeout time.Duration) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	now := time.Now()
+	pl.closeExpired(now, timeout)
+	if len(pl.idle) == 0 {
+		pl.timer = nil
+		return
+	}
+	pl.timer.Reset(pl.idle[0].since.Add(timeout).Sub(now) + time.Millisecond)
+}
+
+// PoolStats describes reuse of backend connections, see Proxy.PoolStats.
+type PoolStats struct {
+	Hits   int64 `json:"hits"`   // requests sent over reused connections
+	Misses int64 `json:"misses"` // requests that needed a new connection
+	Idle   int   `json:"idle"`   // idle connections kept for reuse
+}
+
+// PoolStats returns statistics of backend connection reuse, see
+// MaxIdleConns.
+func (p *Proxy) PoolStats() PoolStats {
+	p.pool.mu.Lock()
+	idle := len(p.pool.idle)
+	p.pool.mu.Unlock()
+	return PoolStats{Hits: p.pool.hits.Load(), Misses: p.pool.misses.Load(), Idle: idle}
+}
+
+// CloseIdleConnections closes backend connections kept for reuse.
+func (p *Proxy) CloseIdleConnections() {
+	pl := &p.pool
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for _, ic := range pl.idle {
+		ic.conn.Close()
+	}
+	clear(pl.idle)
+	pl.idle = pl.idle[:0]
+}
+
+// take returns the most recently used idle connection match reports true
+// for, or nil if there's none. Connections idle for longer than timeout are
+// closed.
+func (pl *connPool) take(timeout time.Duration, match func(net.Conn) bool) net.Conn {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.closeExpired(time.Now(), timeout)
+	for i := len(pl.idle) - 1; i >= 0; i-- {
+		if ic := pl.idle[i]; match(ic.conn) {
+			copy(pl.idle[i:], pl.idle[i+1:])
+			pl.idle[len(pl.idle)-1] = idleConn{}
+			pl.idle = pl.idle[:len(pl.idle)-1]
+			return ic.conn
+		}
+	}
+	return nil
+}
+
+// closeExpired closes connections idle for longer than timeout, it must be
+// called with pl.mu held.
+func (pl *connPool) closeExpired(now time.Time, timeout time.Duration) {
+	var i int
+	for i < len(pl.idle) && now.Sub(pl.idle[i].since) > timeout {
+		pl.idle[i].conn.Close()
+		i++
+	}
+	if i > 0 {
+		n := copy(pl.idle, pl.idle[i:])
+		clear(pl.idle[n:])
+		pl.idle = pl.idle[:n]
+	}
+}
+
+func (p *Proxy) idleConnTimeout() time.Duration {
+	if p.IdleConnTimeout > 0 {
+		return p.IdleConnTimeout
+	}
+	return 90 * time.Second
+}
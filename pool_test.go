@@ -0,0 +1,114 @@
+package uwsgi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func okResponse(map[string]string, []byte) string {
+	return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+}
+
+func TestMaxConnRequests(t *testing.T) {
+	b := &testBackend{handle: okResponse, keepAlive: true}
+	p := &Proxy{DialContext: b.dial, MaxIdleConns: 1, MaxConnRequests: 2}
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	if n := b.dials.Load(); n != 3 {
+		t.Fatalf("backend dialed %d times, want 3", n)
+	}
+	if st, want := p.PoolStats(), (PoolStats{Hits: 2, Misses: 3, Idle: 1}); st != want {
+		t.Fatalf("got %+v, want %+v", st, want)
+	}
+}
+
+func TestMaxConnWait(t *testing.T) {
+	for _, overflow := range []bool{false, true} {
+		release := make(chan struct{})
+		var calls atomic.Int32
+		b := &testBackend{handle: func(vars map[string]string, body []byte) string {
+			if calls.Add(1) == 1 {
+				<-release
+			}
+			return okResponse(vars, body)
+		}}
+		p := &Proxy{DialContext: b.dial, MaxConns: 1,
+			MaxConnWait: 20 * time.Millisecond, ConnWaitOverflow: overflow}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+		for b.dials.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		w := httptest.NewRecorder()
+		res := p.ServeHTTPResult(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		close(release)
+		<-done
+		want := http.StatusServiceUnavailable
+		if overflow {
+			want = http.StatusOK
+		}
+		if res.Status != want {
+			t.Errorf("overflow %v: got status %d, want %d", overflow, res.Status, want)
+		}
+		if res.Wait < p.MaxConnWait {
+			t.Errorf("overflow %v: waited %v, want at least %v", overflow, res.Wait, p.MaxConnWait)
+		}
+	}
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	b := &testBackend{handle: okResponse, keepAlive: true}
+	p := &Proxy{DialContext: b.dial, MaxIdleConns: 2, IdleConnTimeout: 20 * time.Millisecond}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if idle := p.PoolStats().Idle; idle != 1 {
+		t.Fatalf("got %d idle connections, want 1", idle)
+	}
+	// expired connection is closed with no further requests
+	deadline := time.Now().Add(time.Second)
+	for p.PoolStats().Idle != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection is not closed after IdleConnTimeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestRetryBudgetDeposit checks that requests over reused connections count
+// towards RetryBudget the same as those needing a new connection.
+func TestRetryBudgetDeposit(t *testing.T) {
+	b := &testBackend{handle: okResponse, keepAlive: true}
+	budget := &RetryBudget{Ratio: 0.5, MinRetries: -1}
+	p := &Proxy{DialContext: b.dial, MaxIdleConns: 1, RetryBudget: budget}
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+	if n := b.dials.Load(); n != 1 {
+		t.Fatalf("backend dialed %d times, want 1", n)
+	}
+	var retries int
+	for budget.Withdraw() {
+		retries++
+	}
+	if retries != 2 {
+		t.Fatalf("budget allowed %d retries after 4 requests, want 2", retries)
+	}
+}
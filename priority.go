@@ -0,0 +1,103 @@
+package uwsgi
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errShed is returned for requests rejected because queue of requests
+// waiting for a backend connection is full, see Proxy.MaxQueue.
+var errShed = errors.New("request shed: too many requests waiting for backend")
+
+// errConnWait is returned for requests rejected because they waited for
+// a backend connection for too long, see Proxy.MaxConnWait.
+var errConnWait = errors.New("timed out waiting for backend connection")
+
+// limiter limits the number of concurrent holders, queueing the rest in
+// order of priority: higher priorities first, then first come first served.
+type limiter struct {
+	mu      sync.Mutex
+	max     int       // as last passed to acquire
+	active  int       // may exceed max, see overflow
+	waiters []*waiter // ordered by priority, then arrival
+}
+
+type waiter struct {
+	priority int
+	ready    chan error // receives nil once slot is handed over, or errShed
+}
+
+// acquire takes one of max slots, waiting for it if necessary. If maxQueue
+// is positive and that many requests are waiting already, request with the
+// lowest priority among them and the new one is shed.
+func (l *limiter) acquire(ctx context.Context, max, maxQueue, priority int) error {
+	l.mu.Lock()
+	l.max = max
+	if l.active < max {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	if maxQueue > 0 && len(l.waiters) >= maxQueue {
+		last := l.waiters[len(l.waiters)-1]
+		if last.priority >= priority {
+			l.mu.Unlock()
+			return errShed
+		}
+		l.waiters = l.waiters[:len(l.waiters)-1]
+		last.ready <- errShed
+	}
+	w := &waiter{priority: priority, ready: make(chan error, 1)}
+	i := len(l.waiters)
+	for i > 0 && l.waiters[i-1].priority < priority {
+		i--
+	}
+	l.waiters = append(l.waiters, nil)
+	copy(l.waiters[i+1:], l.waiters[i:])
+	l.waiters[i] = w
+	l.mu.Unlock()
+
+	select {
+	case err := <-w.ready:
+		return err
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	for i, w2 := range l.waiters {
+		if w2 == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+	l.mu.Unlock()
+	// already handed a slot or shed concurrently with cancellation
+	if err := <-w.ready; err == nil {
+		l.release()
+	}
+	return ctx.Err()
+}
+
+// overflow takes a slot over the limit without waiting; it must be released
+// with release too.
+func (l *limiter) overflow() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active++
+}
+
+// release frees slot taken by acquire or overflow, handing it over to the
+// first waiter if there is one and the limit is not exceeded.
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) == 0 || l.active > l.max {
+		l.active--
+		return
+	}
+	w := l.waiters[0]
+	l.waiters[0] = nil
+	l.waiters = l.waiters[1:]
+	w.ready <- nil
+}
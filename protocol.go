@@ -0,0 +1,152 @@
+package uwsgi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Protocol specifies how requests are framed when sent to the backend.
+type Protocol int
+
+const (
+	// ProtocolUwsgi is the uwsgi binary protocol, the default.
+	ProtocolUwsgi Protocol = iota
+	// ProtocolHTTP is plain HTTP/1.1, as spoken by uWSGI sockets
+	// configured with --http-socket option. Variables that have no HTTP
+	// counterpart (like REMOTE_ADDR) are not passed to such backends.
+	ProtocolHTTP
+	// ProtocolAuto makes Proxy probe the backend to detect which protocol
+	// it speaks. Detection is done on the first request (or upfront by
+	// calling Proxy.Detect), and repeated after the first failed exchange
+	// with the backend, which eases migrations where socket type changes
+	// between deploys.
+	ProtocolAuto
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolUwsgi:
+		return "uwsgi"
+	case ProtocolHTTP:
+		return "http"
+	case ProtocolAuto:
+		return "auto"
+	}
+	return "unknown"
+}
+
+// Detect probes the backend to find out whether it speaks uwsgi or HTTP
+// protocol and caches the result for use with ProtocolAuto.
+func (p *Proxy) Detect(ctx context.Context) (Protocol, error) {
+	conn, err := p.DialContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(probeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	proto, err := probe(conn)
+	if err != nil {
+		return 0, err
+	}
+	atomic.StoreInt32(&p.detected, int32(proto)+1)
+	return proto, nil
+}
+
+// protocol returns protocol to use for the next exchange with the backend.
+func (p *Proxy) protocol(ctx context.Context) (Protocol, error) {
+	if p.Protocol != ProtocolAuto {
+		return p.Protocol, nil
+	}
+	if v := atomic.LoadInt32(&p.detected); v != 0 {
+		return Protocol(v - 1), nil
+	}
+	proto, err := p.Detect(ctx)
+	if err != nil {
+		return ProtocolUwsgi, err
+	}
+	return proto, nil
+}
+
+// resetProtocol discards cached result of protocol detection.
+func (p *Proxy) resetProtocol() { atomic.StoreInt32(&p.detected, 0) }
+
+// probe sends uwsgi ping packet over conn and checks the reply: uWSGI
+// responds with a ping packet, while HTTP servers reply with an error. Ping
+// packet is followed by an empty line so that HTTP servers don't wait for
+// the end of request line.
+func probe(conn net.Conn) (Protocol, error) {
+	if _, err := conn.Write([]byte{modifierPing, 0, 0, 0, '\r', '\n', '\r', '\n'}); err != nil {
+		return 0, err
+	}
+	b := make([]byte, 5)
+	n, err := io.ReadFull(conn, b)
+	switch {
+	case n > 0 && b[0] == modifierPing:
+		return ProtocolUwsgi, nil
+	case n == len(b) && string(b) == "HTTP/":
+		return ProtocolHTTP, nil
+	case err != nil && err != io.ErrUnexpectedEOF:
+		return 0, err
+	}
+	return 0, errors.New("cannot detect backend protocol from its reply")
+}
+
+// mismatchHint returns a hint for operator if head, the first bytes of backend
+// reply that couldn't be parsed as HTTP response, suggests that backend
+// expects a different protocol than proto used for the request.
+func mismatchHint(head []byte, proto Protocol) string {
+	switch {
+	case len(head) == 0 && proto == ProtocolHTTP:
+		return "backend closed connection without reply, it may expect uwsgi protocol on this socket"
+	case len(head) == 0:
+		return "backend closed connection without reply, it may expect HTTP protocol on this socket " +
+			"like uWSGI --http-socket does, or request variables exceed its --buffer-size"
+	case len(head) >= 4 && (head[0] == 0 || head[0] == modifierPing) && head[3] == 0:
+		return "backend replied with uwsgi packet instead of HTTP response, " +
+			"check that address points to application socket"
+	case bytes.IndexFunc(head, func(r rune) bool { return r < 0x20 && r != '\r' && r != '\n' }) != -1:
+		return "backend replied with binary data instead of HTTP response"
+	}
+	return ""
+}
+
+// writeHTTP writes request r with given header, method, request-target and
+// body to w as an HTTP/1.1 request. Unless keepAlive is true, request asks
+// backend to close connection after the response.
+func writeHTTP(w io.Writer, r *http.Request, header http.Header, method, requestURI string, body io.Reader, contentLength int64, keepAlive bool) error {
+	u, err := url.ParseRequestURI(requestURI)
+	if err != nil {
+		return err
+	}
+	req := new(http.Request)
+	*req = *r
+	req.Method, req.URL = method, u
+	req.Header = make(http.Header, len(header))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""} // don't add Go default
+	}
+	req.Body = io.NopCloser(body)
+	req.ContentLength = contentLength
+	req.TransferEncoding = nil
+	req.Close = !keepAlive
+	return req.Write(w)
+}
+
+const (
+	modifierPing = 100         // uwsgi ping packet modifier1
+	probeTimeout = time.Second // default timeout for protocol probe
+)
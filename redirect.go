@@ -0,0 +1,43 @@
+package uwsgi
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// redirect replies with a redirect if request has to be redirected to HTTPS
+// or to canonical host, and reports whether it did so.
+func (p *Proxy) redirect(w http.ResponseWriter, r *http.Request) bool {
+	toHTTPS := p.RedirectHTTPS && !p.isHTTPS(r)
+	toHost := p.CanonicalHost != "" && !strings.EqualFold(r.Host, p.CanonicalHost)
+	if !toHTTPS && !toHost {
+		return false
+	}
+	scheme, host := "http", r.Host
+	if p.isHTTPS(r) || toHTTPS {
+		scheme = "https"
+	}
+	if toHost {
+		host = p.CanonicalHost
+	}
+	if toHTTPS {
+		if h, port, err := net.SplitHostPort(host); err == nil && port == "80" {
+			host = h
+		}
+	}
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		code = http.StatusPermanentRedirect // preserves method and body
+	}
+	http.Redirect(w, r, scheme+"://"+host+requestURI(r), code)
+	return true
+}
+
+// isHTTPS reports whether request was received over TLS, either directly or
+// by the front proxy. X-Forwarded-Proto header is only honored if request
+// came from a trusted peer, see ForwardedTrust.
+func (p *Proxy) isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https" ||
+		r.Header.Get("X-Forwarded-Proto") == "https" && p.trustHeaders(r)
+}
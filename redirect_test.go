@@ -0,0 +1,42 @@
+package uwsgi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestForwardedProto(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		peer     string
+		redirect bool // whether RedirectHTTPS is set
+		code     int
+		https    string // HTTPS variable passed to the backend
+	}{
+		{"trusted peer", "10.0.0.1:1234", true, http.StatusOK, "on"},
+		{"untrusted peer", "192.0.2.1:1234", true, http.StatusMovedPermanently, ""},
+		{"untrusted peer vars", "192.0.2.1:1234", false, http.StatusOK, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &testBackend{handle: okResponse}
+			p := &Proxy{DialContext: b.dial, RedirectHTTPS: tc.redirect,
+				TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tc.peer
+			r.Header.Set("X-Forwarded-Proto", "https")
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Code != tc.code {
+				t.Fatalf("got status %d, want %d", w.Code, tc.code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := b.lastVars()["HTTPS"]; got != tc.https {
+				t.Fatalf("got HTTPS=%q, want %q", got, tc.https)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package uwsgi
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Resolver looks up addresses of a host. *net.Resolver implements it, so
+// custom DNS servers can be used by setting its Dial field.
+//
+// DialTCP passes request context to LookupHost, so resolver can override
+// resolution per request based on context values.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// DialTCP returns DialFunc connecting to TCP address in host:port form,
+// looking up host with resolver instead of the system default. Resolved
+// addresses are tried in order until connection succeeds. If resolver is nil,
+// net.DefaultResolver is used.
+func DialTCP(address string, resolver Resolver) DialFunc {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	var d net.Dialer
+	return func(ctx context.Context) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs := []string{host}
+		if _, err := netip.ParseAddr(host); err != nil {
+			if addrs, err = resolver.LookupHost(ctx, host); err != nil {
+				return nil, err
+			}
+			if len(addrs) == 0 {
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+		}
+		for _, addr := range addrs {
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(addr, port)); err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+		return nil, err
+	}
+}
+
+// StaticResolver is a Resolver answering from a static table, like hosts
+// file, and using Fallback resolver for hosts not in the table.
+type StaticResolver struct {
+	Hosts    map[string][]string // host names to their addresses
+	Fallback Resolver            // if nil, net.DefaultResolver is used
+}
+
+func (sr *StaticResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := sr.Hosts[strings.TrimSuffix(host, ".")]; ok {
+		return addrs, nil
+	}
+	if sr.Fallback != nil {
+		return sr.Fallback.LookupHost(ctx, host)
+	}
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
@@ -0,0 +1,132 @@
+package uwsgi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Result describes how the request was handled by Proxy, see
+// Proxy.ServeHTTPResult.
+type Result struct {
+	Status  int    // response status sent to the client, 0 if none; see Code
+	Bytes   int64  // number of response body bytes sent to the client
+	Backend string // backend address, empty if connection was not made
+	Retries int    // number of times request was resent to the backend
+
+	// Err is the error that caused Proxy to reply with an error status,
+	// or interrupted sending of the response.
+	Err error
+
+	Start  time.Time     // time request handling started
+	Wait   time.Duration // time spent waiting for connection slot, see Proxy.MaxConns
+	Dial   time.Duration // time spent connecting to the backend
+	Header time.Duration // time from Start until response headers were read
+	Total  time.Duration // time from Start until request was handled
+
+	// Phase is the last phase of exchange with the backend request has
+	// reached, telling where it was aborted or failed.
+	Phase Phase
+}
+
+// StatusClientClosedRequest is a non-standard status code nginx uses for
+// requests abandoned by the client before response was sent, see
+// Result.Code.
+const StatusClientClosedRequest = 499
+
+// Code returns status code to account request with in access logs and
+// metrics: Status, or StatusClientClosedRequest if client went away before
+// response was started, so that such requests can be told apart from
+// backend failures.
+func (res Result) Code() int {
+	if res.Status == 0 && errors.Is(res.Err, context.Canceled) {
+		return StatusClientClosedRequest
+	}
+	return res.Status
+}
+
+// Phase is a phase of exchange with the backend, see Result.
+type Phase int
+
+const (
+	PhaseRequest Phase = iota // request processing before contacting backend
+	PhaseDial                 // waiting for backend connection
+	PhaseWrite                // sending request to the backend
+	PhaseHeader               // waiting for response headers
+	PhaseBody                 // copying response body to the client
+)
+
+func (ph Phase) String() string {
+	switch ph {
+	case PhaseRequest:
+		return "request"
+	case PhaseDial:
+		return "dial"
+	case PhaseWrite:
+		return "write"
+	case PhaseHeader:
+		return "header"
+	case PhaseBody:
+		return "body"
+	}
+	return "Phase(" + strconv.Itoa(int(ph)) + ")"
+}
+
+// replyError replies to the client with the given status code and text
+// (status text if empty), recording err in res. Reply is rendered as JSON
+// problem details if p.JSONErrors is set.
+func (p *Proxy) replyError(w http.ResponseWriter, r *http.Request, res *Result, code int, text string, err error) {
+	res.Err = err
+	if text == "" {
+		text = http.StatusText(code)
+	}
+	if !p.JSONErrors {
+		http.Error(w, text, code)
+		return
+	}
+	header := p.CorrelationHeader
+	if header == "" {
+		header = "X-Request-Id"
+	}
+	id := r.Header.Get(header)
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	problem := struct {
+		Type          string `json:"type"`
+		Title         string `json:"title"`
+		Status        int    `json:"status"`
+		Detail        string `json:"detail,omitempty"`
+		CorrelationID string `json:"correlation_id"`
+	}{
+		Type:          "about:blank",
+		Title:         http.StatusText(code),
+		Status:        code,
+		CorrelationID: id,
+	}
+	if text != problem.Title {
+		problem.Detail = text
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/problem+json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set(header, id)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(problem)
+}
+
+var (
+	errDraining         = errors.New("proxy is draining")
+	errMethodNotAllowed = errors.New("method not allowed")
+	errUnknownMethod    = errors.New("unknown method")
+	errMaintenance      = errors.New("scheduled maintenance")
+	errReadOnly         = errors.New("read-only mode")
+)
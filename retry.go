@@ -0,0 +1,106 @@
+package uwsgi
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryBudget limits retries to a fraction of requests over a sliding window,
+// preventing retries from amplifying load on backends during partial
+// outages. It can be shared by multiple Proxy instances. It's safe for
+// concurrent use.
+type RetryBudget struct {
+	// Ratio is the max ratio of retries to requests, 0.2 if zero.
+	Ratio float64
+
+	// MinRetries is the number of retries allowed within the window
+	// regardless of Ratio, so that handlers with little traffic can still
+	// retry. If zero, 10 is used; negative value disables this.
+	MinRetries int
+
+	// Window is the duration of sliding window, 10 seconds if zero.
+	Window time.Duration
+
+	mu      sync.Mutex
+	buckets [retryBuckets]retryBucket
+}
+
+type retryBucket struct {
+	epoch             int64 // bucket start time, in bucket size units
+	requests, retries int
+}
+
+// Deposit records a request, increasing the budget.
+func (b *RetryBudget) Deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(time.Now()).requests++
+}
+
+// Withdraw reports whether a retry is allowed by the budget, recording it if
+// so.
+func (b *RetryBudget) Withdraw() bool {
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var requests, retries int
+	oldest := now.UnixNano()/int64(b.bucketSize()) - retryBuckets
+	for _, bk := range b.buckets {
+		if bk.epoch > oldest {
+			requests += bk.requests
+			retries += bk.retries
+		}
+	}
+	ratio := b.Ratio
+	if ratio <= 0 {
+		ratio = 0.2
+	}
+	minRetries := b.MinRetries
+	if minRetries == 0 {
+		minRetries = 10
+	}
+	if retries >= minRetries && float64(retries+1) > ratio*float64(requests) {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// bucket returns bucket for the given time, it must be called with b.mu
+// held.
+func (b *RetryBudget) bucket(now time.Time) *retryBucket {
+	epoch := now.UnixNano() / int64(b.bucketSize())
+	bk := &b.buckets[epoch%retryBuckets]
+	if bk.epoch != epoch {
+		*bk = retryBucket{epoch: epoch}
+	}
+	return bk
+}
+
+func (b *RetryBudget) bucketSize() time.Duration {
+	d := b.Window
+	if d <= 0 {
+		d = 10 * time.Second
+	}
+	return d / retryBuckets
+}
+
+const retryBuckets = 10
+
+// canResend reports whether request may be sent to the backend again after
+// sending it failed: it must have no body and a safe method, or have its
+// body spooled, which is then rewound.
+func canResend(method string, contentLength int64, sp *spooled) bool {
+	if sp != nil {
+		return sp.rewind() == nil
+	}
+	return contentLength == 0 && safeMethod(method)
+}
+
+// backendClosed reports whether err tells that backend closed connection,
+// like uWSGI does when recycling workers.
+func backendClosed(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
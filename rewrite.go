@@ -0,0 +1,87 @@
+package uwsgi
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ModifyAll returns function for Proxy.ModifyResponse calling each of fns in
+// order, stopping at the first error.
+func ModifyAll(fns ...func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, fn := range fns {
+			if err := fn(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// RewriteLocation returns function for Proxy.ModifyResponse replacing from
+// prefix of Location and Content-Location response headers with to, like
+// nginx proxy_redirect directive does. This fixes redirects of backends
+// unaware of their public address or mount point:
+//
+//	p.ModifyResponse = uwsgi.RewriteLocation("http://127.0.0.1:8000/", "https://example.com/app/")
+func RewriteLocation(from, to string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, k := range [...]string{"Location", "Content-Location"} {
+			if v := resp.Header.Get(k); strings.HasPrefix(v, from) {
+				resp.Header.Set(k, to+v[len(from):])
+			}
+		}
+		return nil
+	}
+}
+
+// RewriteCookieDomain returns function for Proxy.ModifyResponse replacing
+// Domain attribute of Set-Cookie response headers equal to from
+// (case-insensitive, ignoring leading dot) with to, like nginx
+// proxy_cookie_domain directive does. Empty to removes the attribute, which
+// restricts cookie to the host that set it.
+func RewriteCookieDomain(from, to string) func(*http.Response) error {
+	from = strings.TrimPrefix(from, ".")
+	return rewriteCookies("Domain", func(v string) (string, bool) {
+		if !strings.EqualFold(strings.TrimPrefix(v, "."), from) {
+			return v, true
+		}
+		return to, to != ""
+	})
+}
+
+// RewriteCookiePath returns function for Proxy.ModifyResponse replacing from
+// prefix of Path attribute of Set-Cookie response headers with to, like
+// nginx proxy_cookie_path directive does.
+func RewriteCookiePath(from, to string) func(*http.Response) error {
+	return rewriteCookies("Path", func(v string) (string, bool) {
+		if strings.HasPrefix(v, from) {
+			return to + v[len(from):], true
+		}
+		return v, true
+	})
+}
+
+// rewriteCookies returns function applying fn to values of the named
+// attribute of Set-Cookie response headers; attribute is removed if fn
+// returns false. Other parts of cookies are left intact.
+func rewriteCookies(attr string, fn func(string) (string, bool)) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for i, line := range resp.Header["Set-Cookie"] {
+			parts := strings.Split(line, ";")
+			out := parts[:1] // name=value
+			for _, part := range parts[1:] {
+				name, value, ok := strings.Cut(part, "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(name), attr) {
+					out = append(out, part)
+					continue
+				}
+				if value, ok = fn(strings.TrimSpace(value)); ok {
+					out = append(out, name+"="+value)
+				}
+			}
+			resp.Header["Set-Cookie"][i] = strings.Join(out, ";")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,263 @@
+package uwsgi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RoutingConfig describes Balancer backends and TenantRouter routes, it's
+// applied at runtime with Admin.Apply.
+type RoutingConfig struct {
+	// Backends are addresses of Balancer backends.
+	Backends []string `json:"backends,omitempty"`
+
+	// Routes are TenantRouter tenants by their keys.
+	Routes map[string]RouteConfig `json:"routes,omitempty"`
+}
+
+// RouteConfig describes a tenant served by its own backend. BufferSize and
+// MaxResponseHeaderBytes set limits of Proxy serving the route, so that
+// they reflect configuration of each backend.
+type RouteConfig struct {
+	Backend string `json:"backend"`         // backend address
+	Mount   string `json:"mount,omitempty"` // see Tenant.Mount
+	AppID   string `json:"appId,omitempty"` // see Tenant.AppID
+
+	BufferSize             int   `json:"bufferSize,omitempty"`             // see Proxy.BufferSize
+	MaxResponseHeaderBytes int64 `json:"maxResponseHeaderBytes,omitempty"` // see Proxy.MaxResponseHeaderBytes
+}
+
+// Validate checks configuration for errors.
+func (c RoutingConfig) Validate() error {
+	var errs []error
+	seen := make(map[string]bool, len(c.Backends))
+	for _, addr := range c.Backends {
+		switch {
+		case addr == "":
+			errs = append(errs, errors.New("empty backend address"))
+		case seen[addr]:
+			errs = append(errs, fmt.Errorf("duplicate backend %q", addr))
+		}
+		seen[addr] = true
+	}
+	for _, key := range routeKeys(c.Routes) {
+		rc := c.Routes[key]
+		if key == "" {
+			errs = append(errs, errors.New("route with empty key"))
+		}
+		if rc.Backend == "" {
+			errs = append(errs, fmt.Errorf("route %q: empty backend address", key))
+		}
+		if rc.Mount != "" && !strings.HasPrefix(rc.Mount, "/") {
+			errs = append(errs, fmt.Errorf("route %q: mount %q must start with /", key, rc.Mount))
+		}
+		if err := validateBufferSize(rc.BufferSize); err != nil {
+			errs = append(errs, fmt.Errorf("route %q: %w", key, err))
+		}
+		if rc.MaxResponseHeaderBytes < 0 {
+			errs = append(errs, fmt.Errorf("route %q: negative MaxResponseHeaderBytes %d",
+				key, rc.MaxResponseHeaderBytes))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RoutingDiff describes changes between two RoutingConfig values, see
+// RoutingConfig.Diff.
+type RoutingDiff struct {
+	BackendsAdded   []string `json:"backendsAdded,omitempty"`
+	BackendsRemoved []string `json:"backendsRemoved,omitempty"`
+	RoutesAdded     []string `json:"routesAdded,omitempty"`
+	RoutesRemoved   []string `json:"routesRemoved,omitempty"`
+	RoutesChanged   []string `json:"routesChanged,omitempty"`
+}
+
+// Diff returns changes needed to turn c into next.
+func (c RoutingConfig) Diff(next RoutingConfig) RoutingDiff {
+	var d RoutingDiff
+	d.BackendsAdded = missing(next.Backends, c.Backends)
+	d.BackendsRemoved = missing(c.Backends, next.Backends)
+	for _, key := range routeKeys(next.Routes) {
+		old, ok := c.Routes[key]
+		switch {
+		case !ok:
+			d.RoutesAdded = append(d.RoutesAdded, key)
+		case old != next.Routes[key]:
+			d.RoutesChanged = append(d.RoutesChanged, key)
+		}
+	}
+	for _, key := range routeKeys(c.Routes) {
+		if _, ok := next.Routes[key]; !ok {
+			d.RoutesRemoved = append(d.RoutesRemoved, key)
+		}
+	}
+	return d
+}
+
+// Empty reports whether there are no changes.
+func (d RoutingDiff) Empty() bool {
+	return len(d.BackendsAdded)+len(d.BackendsRemoved)+
+		len(d.RoutesAdded)+len(d.RoutesRemoved)+len(d.RoutesChanged) == 0
+}
+
+// String returns summary of changes for logging, like
+// "backends +10.0.0.3:3031 -10.0.0.2:3031; routes +acme ~example".
+func (d RoutingDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	var parts []string
+	list := func(name string, groups ...[]string) {
+		var b strings.Builder
+		for i, marks := range []string{"+", "-", "~"}[:len(groups)] {
+			for _, s := range groups[i] {
+				if b.Len() != 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(marks + s)
+			}
+		}
+		if b.Len() != 0 {
+			parts = append(parts, name+" "+b.String())
+		}
+	}
+	list("backends", d.BackendsAdded, d.BackendsRemoved)
+	list("routes", d.RoutesAdded, d.RoutesRemoved, d.RoutesChanged)
+	return strings.Join(parts, "; ")
+}
+
+// Routing returns configuration last applied with Apply. Until it's called,
+// Backends are those of Balancer and Routes are empty.
+func (a *Admin) Routing() RoutingConfig {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.routing()
+}
+
+// routing returns the current configuration, it must be called with a.mu
+// held.
+func (a *Admin) routing() RoutingConfig {
+	if a.applied != nil {
+		return *a.applied
+	}
+	var c RoutingConfig
+	if a.Balancer != nil {
+		for _, st := range a.Balancer.BackendStatus() {
+			c.Backends = append(c.Backends, st.Addr)
+		}
+	}
+	return c
+}
+
+// Apply validates configuration and applies it to Balancer and Tenants,
+// returning changes made. If dryRun is true, it only validates configuration
+// and reports changes that would be made. Apply is used by /routing admin
+// endpoint; embedders may also call it to reload configuration from a file,
+// e.g. on SIGHUP.
+//
+// Removed backends are given RemoveGrace to finish requests in flight.
+// Handlers of replaced and removed routes get their CloseIdleConnections
+// method called, if they have one. Tenants set on TenantRouter directly are
+// left intact unless their keys are used by the configuration.
+func (a *Admin) Apply(c RoutingConfig, dryRun bool) (RoutingDiff, error) {
+	if err := c.Validate(); err != nil {
+		return RoutingDiff{}, err
+	}
+	if len(c.Backends) != 0 && a.Balancer == nil {
+		return RoutingDiff{}, errors.New("backends are set, but Admin has no Balancer")
+	}
+	if len(c.Backends) == 0 && a.Balancer != nil {
+		return RoutingDiff{}, errors.New("configuration leaves Balancer without backends")
+	}
+	if len(c.Routes) != 0 && a.Tenants == nil {
+		return RoutingDiff{}, errors.New("routes are set, but Admin has no Tenants")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d := a.routing().Diff(c)
+	if dryRun {
+		return d, nil
+	}
+	for _, addr := range d.BackendsAdded {
+		a.Balancer.Add(addr, a.newDial(addr))
+	}
+	for _, addr := range d.BackendsRemoved {
+		a.Balancer.Remove(addr, a.removeGrace())
+	}
+	for _, key := range append(d.RoutesAdded, d.RoutesChanged...) {
+		rc := c.Routes[key]
+		var h http.Handler
+		if a.NewHandler != nil {
+			h = a.NewHandler(key, rc)
+		} else {
+			h = &Proxy{
+				DialContext:            a.newDial(rc.Backend),
+				BufferSize:             rc.BufferSize,
+				MaxResponseHeaderBytes: rc.MaxResponseHeaderBytes,
+			}
+		}
+		old, ok := a.Tenants.get(key)
+		a.Tenants.Set(key, Tenant{Handler: h, Mount: rc.Mount, AppID: rc.AppID})
+		if ok {
+			closeIdle(old.Handler)
+		}
+	}
+	for _, key := range d.RoutesRemoved {
+		old, ok := a.Tenants.get(key)
+		a.Tenants.Delete(key)
+		if ok {
+			closeIdle(old.Handler)
+		}
+	}
+	c.Backends = append([]string(nil), c.Backends...)
+	routes := make(map[string]RouteConfig, len(c.Routes))
+	for k, v := range c.Routes {
+		routes[k] = v
+	}
+	c.Routes = routes
+	a.applied = &c
+	return d, nil
+}
+
+func (a *Admin) newDial(addr string) DialFunc {
+	if a.NewDial != nil {
+		return a.NewDial(addr)
+	}
+	return Dial(addrNetwork(addr), addr)
+}
+
+func (a *Admin) removeGrace() time.Duration {
+	if a.RemoveGrace > 0 {
+		return a.RemoveGrace
+	}
+	return 30 * time.Second
+}
+
+// routeKeys returns sorted keys of routes.
+func routeKeys(routes map[string]RouteConfig) []string {
+	keys := make([]string, 0, len(routes))
+	for k := range routes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// missing returns elements of list that are not in other.
+func missing(list, other []string) []string {
+	set := make(map[string]bool, len(other))
+	for _, s := range other {
+		set[s] = true
+	}
+	var out []string
+	for _, s := range list {
+		if !set[s] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,205 @@
+package uwsgi
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoutingValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		c    RoutingConfig
+		err  string // substring of expected error, empty if valid
+	}{
+		{name: "valid", c: RoutingConfig{Backends: []string{"a", "b"},
+			Routes: map[string]RouteConfig{"acme": {Backend: "c", Mount: "/acme", BufferSize: 8192}}}},
+		{name: "empty", c: RoutingConfig{}},
+		{name: "empty backend", c: RoutingConfig{Backends: []string{""}}, err: "empty backend address"},
+		{name: "duplicate backend", c: RoutingConfig{Backends: []string{"a", "a"}}, err: `duplicate backend "a"`},
+		{name: "empty route key", c: RoutingConfig{Routes: map[string]RouteConfig{"": {Backend: "c"}}},
+			err: "route with empty key"},
+		{name: "route without backend", c: RoutingConfig{Routes: map[string]RouteConfig{"acme": {}}},
+			err: `route "acme": empty backend address`},
+		{name: "relative mount", c: RoutingConfig{Routes: map[string]RouteConfig{"acme": {Backend: "c", Mount: "acme"}}},
+			err: `route "acme": mount "acme" must start with /`},
+		{name: "negative header limit", c: RoutingConfig{Routes: map[string]RouteConfig{
+			"acme": {Backend: "c", MaxResponseHeaderBytes: -1}}}, err: "negative MaxResponseHeaderBytes"},
+	} {
+		err := tc.c.Validate()
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestRoutingDiff(t *testing.T) {
+	old := RoutingConfig{
+		Backends: []string{"a", "b"},
+		Routes: map[string]RouteConfig{
+			"acme":    {Backend: "c"},
+			"example": {Backend: "d"},
+			"gone":    {Backend: "e"},
+		},
+	}
+	next := RoutingConfig{
+		Backends: []string{"b", "f"},
+		Routes: map[string]RouteConfig{
+			"acme":    {Backend: "c"},
+			"example": {Backend: "d", Mount: "/example"},
+			"new":     {Backend: "g"},
+		},
+	}
+	d := old.Diff(next)
+	want := RoutingDiff{
+		BackendsAdded:   []string{"f"},
+		BackendsRemoved: []string{"a"},
+		RoutesAdded:     []string{"new"},
+		RoutesRemoved:   []string{"gone"},
+		RoutesChanged:   []string{"example"},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Fatalf("got %+v, want %+v", d, want)
+	}
+	if got, want := d.String(), "backends +f -a; routes +new -gone ~example"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if d := next.Diff(next); !d.Empty() || d.String() != "no changes" {
+		t.Fatalf("diff of the same config: got %v", d)
+	}
+}
+
+// idleCloser is a handler counting CloseIdleConnections calls.
+type idleCloser struct {
+	http.Handler
+	closed int
+}
+
+func (h *idleCloser) CloseIdleConnections() { h.closed++ }
+
+func TestAdminApply(t *testing.T) {
+	b := NewBalancer(BalanceRoundRobin, "a")
+	handlers := make(map[string]*idleCloser)
+	admin := &Admin{
+		Proxy:    &Proxy{DialContext: b.DialContext},
+		Balancer: b,
+		Tenants:  new(TenantRouter),
+		NewDial:  func(string) DialFunc { return new(testBackend).dial },
+		NewHandler: func(key string, rc RouteConfig) http.Handler {
+			h := &idleCloser{Handler: http.NotFoundHandler()}
+			handlers[key+" "+rc.Backend] = h
+			return h
+		},
+	}
+	backends := func() []string {
+		var out []string
+		for _, st := range b.BackendStatus() {
+			out = append(out, st.Addr)
+		}
+		return out
+	}
+	if got := admin.Routing(); !reflect.DeepEqual(got, RoutingConfig{Backends: []string{"a"}}) {
+		t.Fatalf("initial routing: got %+v", got)
+	}
+
+	c := RoutingConfig{
+		Backends: []string{"a", "b"},
+		Routes:   map[string]RouteConfig{"acme": {Backend: "c", Mount: "/acme", AppID: "acme"}},
+	}
+	d, err := admin.Apply(c, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (RoutingDiff{BackendsAdded: []string{"b"}, RoutesAdded: []string{"acme"}}); !reflect.DeepEqual(d, want) {
+		t.Fatalf("dry run: got %+v, want %+v", d, want)
+	}
+	if got := backends(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("dry run changed backends: %q", got)
+	}
+	if _, ok := admin.Tenants.get("acme"); ok || len(handlers) != 0 {
+		t.Fatal("dry run added route")
+	}
+
+	if _, err := admin.Apply(c, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := backends(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("got backends %q", got)
+	}
+	tn, ok := admin.Tenants.get("acme")
+	if !ok || tn.Mount != "/acme" || tn.AppID != "acme" || tn.Handler != handlers["acme c"] {
+		t.Fatalf("got tenant %+v, %v", tn, ok)
+	}
+	c.Routes["acme"] = RouteConfig{Backend: "mutated"} // must not affect applied config
+	if got := admin.Routing().Routes["acme"].Backend; got != "c" {
+		t.Fatalf("applied config changed with caller's map: backend %q", got)
+	}
+
+	// change route backend, then remove it
+	c = RoutingConfig{Backends: []string{"b"}, Routes: map[string]RouteConfig{"acme": {Backend: "d"}}}
+	if d, err = admin.Apply(c, false); err != nil {
+		t.Fatal(err)
+	}
+	if want := (RoutingDiff{BackendsRemoved: []string{"a"}, RoutesChanged: []string{"acme"}}); !reflect.DeepEqual(d, want) {
+		t.Fatalf("got %+v, want %+v", d, want)
+	}
+	if got := backends(); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("got backends %q", got)
+	}
+	if tn, _ := admin.Tenants.get("acme"); tn.Handler != handlers["acme d"] || handlers["acme c"].closed != 1 {
+		t.Fatal("route handler is not replaced, or old one's idle connections are not closed")
+	}
+	if _, err := admin.Apply(RoutingConfig{Backends: []string{"b"}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := admin.Tenants.get("acme"); ok || handlers["acme d"].closed != 1 {
+		t.Fatal("route is not removed, or its idle connections are not closed")
+	}
+
+	noBalancer := &Admin{Proxy: &Proxy{}}
+	for _, tc := range []struct {
+		admin *Admin
+		c     RoutingConfig
+	}{
+		{admin: admin, c: RoutingConfig{}}, // no backends left
+		{admin: admin, c: RoutingConfig{Backends: []string{"b", "b"}}},
+		{admin: noBalancer, c: RoutingConfig{Backends: []string{"a"}}},
+		{admin: noBalancer, c: RoutingConfig{Routes: map[string]RouteConfig{"x": {Backend: "y"}}}},
+	} {
+		if _, err := tc.admin.Apply(tc.c, true); err == nil {
+			t.Fatalf("%+v: no error", tc.c)
+		}
+	}
+}
+
+func TestAdminRoutingEndpoint(t *testing.T) {
+	b := NewBalancer(BalanceRoundRobin, "a")
+	admin := &Admin{Proxy: &Proxy{DialContext: b.DialContext}, Balancer: b,
+		NewDial: func(string) DialFunc { return new(testBackend).dial }}
+	w := adminDo(admin, "PUT", "/routing?dry-run", `{"backends": ["a", "b"]}`)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"backendsAdded":["b"]}` {
+		t.Fatalf("dry run: got status %d, body %s", w.Code, w.Body)
+	}
+	if len(b.BackendStatus()) != 1 {
+		t.Fatal("dry run added backend")
+	}
+	if w := adminDo(admin, "PUT", "/routing", `{"backends": ["a", "a"]}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid config: got status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if w := adminDo(admin, "PUT", "/routing", `{"backends": ["b"]}`); w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var c RoutingConfig
+	w = adminDo(admin, "GET", "/routing", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, RoutingConfig{Backends: []string{"b"}}) {
+		t.Fatalf("got routing %+v", c)
+	}
+}
@@ -0,0 +1,154 @@
+package uwsgi
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Policy is a behavior Proxy applies for the duration of a scheduled
+// Window, see Proxy.Schedule. Policies can be combined with "|".
+type Policy int
+
+const (
+	// PolicyMaintenance rejects all requests with 503 Service Unavailable
+	// status.
+	PolicyMaintenance Policy = 1 << iota
+	// PolicyReadOnly rejects requests with methods other than GET, HEAD,
+	// OPTIONS, and TRACE with 503 Service Unavailable status.
+	PolicyReadOnly
+)
+
+// Window is a time interval starting at Start (inclusive) and ending at End
+// (exclusive).
+type Window struct {
+	Start, End time.Time
+}
+
+// scheduled is a Policy applied during a Window.
+type scheduled struct {
+	Window
+	policy Policy
+}
+
+// Schedule makes Proxy apply policy during the window, for example to reject
+// writes while database migration runs. Rejected requests get Retry-After
+// header pointing to the end of the window. Windows may overlap, their
+// policies are then combined. Returned function cancels the schedule.
+func (p *Proxy) Schedule(w Window, policy Policy) (cancel func()) {
+	s := &scheduled{Window: w, policy: policy}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.schedule = append(p.schedule, s)
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i, s2 := range p.schedule {
+			if s2 == s {
+				p.schedule = append(p.schedule[:i], p.schedule[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// SetReadOnly switches read-only mode on or off: while it's on, requests
+// are rejected the same way as with PolicyReadOnly, with Retry-After header
+// set to retryAfter. It's meant for unplanned events like backend database
+// failover; see Schedule for planned ones.
+func (p *Proxy) SetReadOnly(on bool, retryAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readOnly, p.readOnlyRetry = on, retryAfter
+}
+
+// ReadOnly reports whether read-only mode is switched on with SetReadOnly.
+func (p *Proxy) ReadOnly() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.readOnly
+}
+
+// SetMaintenance switches maintenance mode on or off: while it's on, all
+// requests are rejected the same way as with PolicyMaintenance, with
+// Retry-After header set to retryAfter.
+func (p *Proxy) SetMaintenance(on bool, retryAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maintenance, p.maintRetry = on, retryAfter
+}
+
+// Maintenance reports whether maintenance mode is switched on with
+// SetMaintenance.
+func (p *Proxy) Maintenance() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maintenance
+}
+
+// policyAt returns combined policy of windows active at time now, including
+// read-only and maintenance modes, and the time the last of them ends.
+func (p *Proxy) policyAt(now time.Time) (Policy, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var policy Policy
+	var end time.Time
+	if p.readOnly {
+		policy, end = PolicyReadOnly, now.Add(p.readOnlyRetry)
+	}
+	if p.maintenance {
+		policy |= PolicyMaintenance
+		if t := now.Add(p.maintRetry); t.After(end) {
+			end = t
+		}
+	}
+	schedule := p.schedule[:0]
+	for _, s := range p.schedule {
+		if !now.Before(s.End) {
+			continue // expired
+		}
+		schedule = append(schedule, s)
+		if now.Before(s.Start) {
+			continue
+		}
+		policy |= s.policy
+		if s.End.After(end) {
+			end = s.End
+		}
+	}
+	clear(p.schedule[len(schedule):])
+	p.schedule = schedule
+	return policy, end
+}
+
+// applySchedule replies with 503 Service Unavailable status if request is
+// rejected by the policy scheduled for the current time, and reports whether
+// it did so.
+func (p *Proxy) applySchedule(w http.ResponseWriter, r *http.Request, res *Result) bool {
+	now := time.Now()
+	policy, end := p.policyAt(now)
+	var err error
+	switch {
+	case policy&PolicyMaintenance != 0:
+		err = errMaintenance
+	case policy&PolicyReadOnly != 0 && !safeMethod(r.Method):
+		err = errReadOnly
+	default:
+		return false
+	}
+	if secs := math.Ceil(end.Sub(now).Seconds()); secs > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(secs)))
+	}
+	p.replyError(w, r, res, http.StatusServiceUnavailable, "", err)
+	return true
+}
+
+// safeMethod reports whether method is safe, i.e. doesn't modify state.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
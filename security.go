@@ -0,0 +1,34 @@
+package uwsgi
+
+import (
+	"net/http"
+	"net/textproto"
+)
+
+// RecommendedSecurityHeaders returns a set of security headers suitable for
+// Proxy.SecurityHeaders in most deployments. Content-Security-Policy is not
+// included as it is application-specific; add it to the returned value if
+// needed:
+//
+//	h := uwsgi.RecommendedSecurityHeaders()
+//	h.Set("Content-Security-Policy", "default-src 'self'")
+//	p := &uwsgi.Proxy{DialContext: dial, SecurityHeaders: h}
+func RecommendedSecurityHeaders() http.Header {
+	return http.Header{
+		"Strict-Transport-Security": {"max-age=63072000; includeSubDomains"},
+		"X-Content-Type-Options":    {"nosniff"},
+		"X-Frame-Options":           {"SAMEORIGIN"},
+		"Referrer-Policy":           {"strict-origin-when-cross-origin"},
+	}
+}
+
+// addMissingHeaders copies headers from src to dst, skipping those already
+// present in dst.
+func addMissingHeaders(dst, src http.Header) {
+	for k, v := range src {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		if _, ok := dst[k]; !ok {
+			dst[k] = v
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package uwsgi
+
+import (
+	"net/http"
+	"time"
+)
+
+// NewServer returns http.Server serving h on addr, with timeouts suitable for
+// proxying to uWSGI: slow clients that take long to send request headers or
+// keep idle connections open don't hold resources indefinitely. Read and
+// write timeouts are not set, as they would break long uploads and streaming
+// responses; use Proxy.ResponseIdleTimeout to limit backends instead.
+//
+// Returned server can be adjusted before use.
+func NewServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    maxSize, // larger headers don't fit uwsgi packet anyway
+	}
+}
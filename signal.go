@@ -0,0 +1,29 @@
+package uwsgi
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// sendSignal connects to the backend using dial and sends uWSGI signal
+// packet with the given signal number.
+func sendSignal(ctx context.Context, dial func(context.Context) (net.Conn, error), sig uint8) error {
+	ctx, cancel := context.WithTimeout(ctx, signalTimeout)
+	defer cancel()
+	conn, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = conn.Write([]byte{modifierSignal, 0, 0, sig})
+	return err
+}
+
+const (
+	modifierSignal = 110         // uwsgi signal packet modifier1
+	signalTimeout  = time.Second // timeout for sending signal
+)
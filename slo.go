@@ -0,0 +1,191 @@
+package uwsgi
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SLO tracks success rate of requests over a sliding window, separately for
+// each route and for each backend of the route, and reports when the rate at
+// which error budget is consumed (burn rate) crosses the threshold. Requests
+// that got 5xx responses are considered failed. Use SLO.Handler to wrap
+// handler being tracked.
+//
+// Burn rate is the ratio of observed error rate to the error rate allowed by
+// the objective: burn rate of 1 means error budget is consumed exactly over
+// the SLO period, burn rate of 10 — ten times faster.
+type SLO struct {
+	// Objective is the target ratio of successful requests, e.g. 0.999.
+	Objective float64
+
+	// Window is the duration of sliding window, 5 minutes if zero.
+	Window time.Duration
+
+	// Threshold is the burn rate threshold, 1 if zero.
+	Threshold float64
+
+	// MinRequests is the minimum number of requests within the window for
+	// the burn rate to be evaluated against the threshold.
+	MinRequests int
+
+	// Route, if set, returns route name for the request; by default all
+	// requests belong to a single route with empty name.
+	Route func(*http.Request) string
+
+	// OnChange, if set, is called when burn rate crosses the threshold in
+	// either direction, for the route as a whole with empty backend, and
+	// for the backend of the route; exceeded reports whether burn rate is
+	// now above the threshold. It's called synchronously with request
+	// processing and should not block.
+	OnChange func(route, backend string, burnRate float64, exceeded bool)
+
+	mu      sync.Mutex
+	windows map[sloKey]*sloWindow
+	now     func() time.Time // time.Now if nil, set by tests
+}
+
+type sloKey struct{ route, backend string }
+
+// Handler returns handler that passes requests to h and tracks their
+// results. Backends are known if h is Proxy or passes requests to Proxy;
+// otherwise, or if connection to the backend was not made, requests are
+// only tracked for the route. Requests aborted by client are not tracked.
+func (s *SLO) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		if s.Route != nil {
+			route = s.Route(r)
+		}
+		res := new(Result)
+		r = r.WithContext(context.WithValue(r.Context(), resultKey, res))
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			if sw.status != 0 {
+				s.Record(route, res.Backend, sw.status < 500)
+			}
+		}()
+		h.ServeHTTP(sw, r)
+	})
+}
+
+// Record records result of a single request for the route, and for the
+// backend of the route, unless backend is empty.
+func (s *SLO) Record(route, backend string, ok bool) {
+	now := s.clock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.windows == nil {
+		s.windows = make(map[sloKey]*sloWindow)
+	}
+	s.record(now, sloKey{route: route}, ok)
+	if backend != "" {
+		s.record(now, sloKey{route, backend}, ok)
+	}
+}
+
+// record records result in the window of key, it must be called with s.mu
+// held.
+func (s *SLO) record(now time.Time, key sloKey, ok bool) {
+	win := s.windows[key]
+	if win == nil {
+		win = &sloWindow{}
+		s.windows[key] = win
+	}
+	win.add(now, s.bucketSize(), ok)
+	total, failed := win.sum(now, s.bucketSize())
+	if total < s.MinRequests || total == 0 {
+		return
+	}
+	rate := s.burnRate(total, failed)
+	exceeded := rate > s.threshold()
+	if exceeded != win.exceeded {
+		win.exceeded = exceeded
+		if s.OnChange != nil {
+			s.OnChange(key.route, key.backend, rate, exceeded)
+		}
+	}
+}
+
+// BurnRate returns current burn rate of the backend of the route, or of the
+// route as a whole if backend is empty.
+func (s *SLO) BurnRate(route, backend string) float64 {
+	now := s.clock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	win := s.windows[sloKey{route, backend}]
+	if win == nil {
+		return 0
+	}
+	return s.burnRate(win.sum(now, s.bucketSize()))
+}
+
+func (s *SLO) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func (s *SLO) burnRate(total, failed int) float64 {
+	if total == 0 {
+		return 0
+	}
+	budget := 1 - s.Objective
+	if budget <= 0 {
+		budget = 1e-9
+	}
+	return float64(failed) / float64(total) / budget
+}
+
+func (s *SLO) threshold() float64 {
+	if s.Threshold > 0 {
+		return s.Threshold
+	}
+	return 1
+}
+
+func (s *SLO) bucketSize() time.Duration {
+	d := s.Window
+	if d <= 0 {
+		d = 5 * time.Minute
+	}
+	return d / sloBuckets
+}
+
+const sloBuckets = 60
+
+// sloWindow is a ring of buckets counting requests within a sliding window.
+type sloWindow struct {
+	buckets  [sloBuckets]sloBucket
+	exceeded bool
+}
+
+type sloBucket struct {
+	epoch         int64 // bucket start time, in bucket size units
+	total, failed int
+}
+
+func (w *sloWindow) add(now time.Time, size time.Duration, ok bool) {
+	epoch := now.UnixNano() / int64(size)
+	b := &w.buckets[epoch%sloBuckets]
+	if b.epoch != epoch {
+		*b = sloBucket{epoch: epoch}
+	}
+	b.total++
+	if !ok {
+		b.failed++
+	}
+}
+
+func (w *sloWindow) sum(now time.Time, size time.Duration) (total, failed int) {
+	epoch := now.UnixNano() / int64(size)
+	for _, b := range w.buckets {
+		if epoch-b.epoch < sloBuckets {
+			total += b.total
+			failed += b.failed
+		}
+	}
+	return total, failed
+}
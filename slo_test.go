@@ -0,0 +1,101 @@
+package uwsgi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClock is a time source for tests, advanced manually.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestSLOWindow(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_000_000, 0)}
+	s := &SLO{Objective: 0.9, Window: time.Minute, now: clock.now}
+	for range 5 {
+		s.Record("api", "", false)
+	}
+	clock.advance(30 * time.Second)
+	for range 5 {
+		s.Record("api", "", true)
+	}
+	// 5 of 10 failed with 10% budget
+	if got := s.BurnRate("api", ""); got < 4.99 || got > 5.01 {
+		t.Fatalf("got burn rate %v, want 5", got)
+	}
+	// failures fall out of the window, successes are still in it
+	clock.advance(31 * time.Second)
+	if got := s.BurnRate("api", ""); got != 0 {
+		t.Fatalf("got burn rate %v after failures expired, want 0", got)
+	}
+	// buckets are reused once the ring wraps around
+	clock.advance(time.Minute)
+	s.Record("api", "", false)
+	if got := s.BurnRate("api", ""); got < 9.99 || got > 10.01 {
+		t.Fatalf("got burn rate %v, want 10", got)
+	}
+	if got := s.BurnRate("other", ""); got != 0 {
+		t.Fatalf("got burn rate %v for unknown route, want 0", got)
+	}
+}
+
+func TestSLOOnChange(t *testing.T) {
+	type change struct {
+		route, backend string
+		exceeded       bool
+	}
+	var changes []change
+	clock := &fakeClock{t: time.Unix(1_000_000, 0)}
+	s := &SLO{Objective: 0.9, Window: time.Minute, MinRequests: 10, now: clock.now,
+		OnChange: func(route, backend string, rate float64, exceeded bool) {
+			changes = append(changes, change{route, backend, exceeded})
+		}}
+	for range 9 {
+		s.Record("api", "a", false) // below MinRequests, not evaluated
+	}
+	if len(changes) != 0 {
+		t.Fatalf("got changes %v below MinRequests", changes)
+	}
+	s.Record("api", "b", false)
+	want := []change{{"api", "", true}} // backends have fewer requests each
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("got changes %v, want %v", changes, want)
+	}
+	s.Record("api", "a", false)
+	want = append(want, change{"api", "a", true})
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("got changes %v, want %v", changes, want)
+	}
+	s.Record("api", "a", false) // still exceeded, no new changes
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("got changes %v, want %v", changes, want)
+	}
+	clock.advance(2 * time.Minute)
+	for range 10 {
+		s.Record("api", "a", true)
+	}
+	want = append(want, change{"api", "", false}, change{"api", "a", false})
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("got changes %v, want %v", changes, want)
+	}
+}
+
+func TestSLOHandler(t *testing.T) {
+	b := &testBackend{handle: func(map[string]string, []byte) string {
+		return "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n"
+	}}
+	s := &SLO{Objective: 0.99}
+	h := s.Handler(&Proxy{DialContext: b.dial})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := s.BurnRate("", ""); got < 99 {
+		t.Fatalf("got route burn rate %v, want 100", got)
+	}
+	if got := s.BurnRate("", "pipe"); got < 99 { // net.Pipe address
+		t.Fatalf("got backend burn rate %v, want 100", got)
+	}
+}
@@ -0,0 +1,62 @@
+package uwsgi
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spooled holds data read by spool function either in memory or in
+// a temporary file.
+type spooled struct {
+	io.Reader
+	size int64
+	file *os.File
+}
+
+// Close releases resources held by s, removing temporary file if any.
+func (s *spooled) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if err2 := os.Remove(s.file.Name()); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// rewind makes s read its data from the start again.
+func (s *spooled) rewind() error {
+	_, err := s.Reader.(io.Seeker).Seek(0, io.SeekStart)
+	return err
+}
+
+// spool reads r until EOF, keeping up to memLimit bytes in memory and spilling
+// larger data to a temporary file created in dir (see os.CreateTemp).
+// Returned value must be closed by the caller once no longer needed.
+func spool(r io.Reader, memLimit int64, dir string) (*spooled, error) {
+	buf := new(bytes.Buffer)
+	n, err := io.CopyN(buf, r, memLimit+1)
+	if err == io.EOF {
+		return &spooled{Reader: bytes.NewReader(buf.Bytes()), size: n}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "uwsgi-spool-")
+	if err != nil {
+		return nil, err
+	}
+	s := &spooled{file: f}
+	if s.size, err = io.Copy(f, io.MultiReader(buf, r)); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.Reader = f
+	return s, nil
+}
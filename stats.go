@@ -0,0 +1,133 @@
+package uwsgi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PollStats reads stats of each backend from its uWSGI stats server (see
+// uWSGI --stats option) every interval until ctx is canceled; BalanceLeastBusy
+// strategy relies on them. statsDial returns dialer connecting to the stats
+// server of backend with the given address, or nil if backend has none.
+// Servers are polled concurrently, fn, if not nil, is called with the number
+// of busy workers plus listen queue length of each backend, or error.
+//
+// Backends with unknown load, e.g. because their stats server is not
+// reachable, are tried after those with known load.
+//
+// Backend whose stats report none of its workers accepting requests, as
+// happens when uWSGI is shutting down or reloading gracefully, is considered
+// draining: like failed backends, it gets no new connections unless all
+// backends are failed or draining, while connections already open to it are
+// left to complete. It gets new connections again once stats report workers
+// accepting requests or can't be read.
+func (b *Balancer) PollStats(ctx context.Context, interval time.Duration, statsDial func(addr string) DialFunc, fn func(addr string, load int, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		b.mu.Lock()
+		backends := append([]*balancedBackend(nil), b.backends...)
+		b.mu.Unlock()
+		var wg sync.WaitGroup
+		for _, be := range backends {
+			dial := statsDial(be.addr)
+			if dial == nil {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				load, draining, err := readLoad(ctx, dial, interval)
+				if ctx.Err() != nil {
+					return
+				}
+				b.mu.Lock()
+				be.load, be.sincePoll, be.draining = load, 0, draining
+				if err != nil {
+					be.load = -1
+				}
+				b.mu.Unlock()
+				if fn != nil {
+					fn(be.addr, load, err)
+				}
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lessBusy reports whether be should be tried before other with
+// BalanceLeastBusy strategy. Connections made since the last poll are added
+// to the load, so that backend reported idle is not flooded until the next
+// poll.
+func (be *balancedBackend) lessBusy(other *balancedBackend) bool {
+	switch {
+	case be.load < 0 && other.load < 0:
+		return len(be.conns) < len(other.conns)
+	case be.load < 0 || other.load < 0:
+		return other.load < 0
+	}
+	return be.load+be.sincePoll < other.load+other.sincePoll
+}
+
+// uwsgiStats is the part of uWSGI stats server output used by readLoad.
+type uwsgiStats struct {
+	ListenQueue int `json:"listen_queue"`
+	Workers     []struct {
+		Status    string `json:"status"`
+		Accepting *int   `json:"accepting"` // missing in older uWSGI versions
+	} `json:"workers"`
+}
+
+// readLoad connects to uWSGI stats server with dial and returns the number
+// of busy workers plus listen queue length, and whether backend is draining:
+// it has workers, but none of them is accepting requests. Stats server
+// started with --stats-http is supported too. Reading stats must complete
+// within timeout.
+func readLoad(ctx context.Context, dial DialFunc, timeout time.Duration) (load int, draining bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := dial(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	rd := bufio.NewReader(conn)
+	var body io.Reader = rd
+	if b, _ := rd.Peek(5); string(b) == "HTTP/" {
+		resp, err := http.ReadResponse(rd, nil)
+		if err != nil {
+			return 0, false, err
+		}
+		defer resp.Body.Close()
+		body = resp.Body
+	}
+	var st uwsgiStats
+	if err := json.NewDecoder(body).Decode(&st); err != nil {
+		return 0, false, err
+	}
+	load = st.ListenQueue
+	accepting := 0
+	for _, w := range st.Workers {
+		if w.Status == "busy" {
+			load++
+		}
+		if w.Status != "cheap" && w.Status != "pause" && (w.Accepting == nil || *w.Accepting != 0) {
+			accepting++
+		}
+	}
+	return load, len(st.Workers) != 0 && accepting == 0, nil
+}
@@ -0,0 +1,97 @@
+package uwsgi
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamResponse reports whether response with given headers should be
+// delivered to the client unbuffered, flushing after each write. Backend can
+// choose explicitly with "X-Accel-Buffering: no" (stream) or "yes" (buffer)
+// header, following nginx convention. Server-Sent Events are always streamed.
+func streamResponse(h http.Header) bool {
+	switch strings.ToLower(h.Get("X-Accel-Buffering")) {
+	case "no":
+		return true
+	case "yes":
+		return false
+	}
+	ct := h.Get("Content-Type")
+	mediaType, _, _ := strings.Cut(ct, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if strings.EqualFold(mediaType, "text/event-stream") {
+		return true
+	}
+	// gRPC-Web server-streaming calls send messages as they're produced,
+	// client expects to get them without delay
+	if strings.HasPrefix(ct, "application/grpc-web") {
+		return true
+	}
+	// MJPEG and similar server push streams replace each part as it
+	// arrives, so parts must not be held in buffers
+	return strings.EqualFold(mediaType, "multipart/x-mixed-replace")
+}
+
+// flushWriter flushes underlying ResponseWriter after each write.
+type flushWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, fw.rc.Flush()
+}
+
+// delayedFlushWriter flushes underlying ResponseWriter at most d after each
+// write, so that small writes are batched. It must be stopped once writing
+// is done.
+type delayedFlushWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	d  time.Duration
+
+	mu      sync.Mutex
+	t       *time.Timer
+	pending bool // whether there's a flush scheduled
+}
+
+func (fw *delayedFlushWriter) Write(b []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(b)
+	if fw.pending {
+		return n, err
+	}
+	fw.pending = true
+	if fw.t == nil {
+		fw.t = time.AfterFunc(fw.d, fw.flush)
+	} else {
+		fw.t.Reset(fw.d)
+	}
+	return n, err
+}
+
+func (fw *delayedFlushWriter) flush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if !fw.pending {
+		return // stopped
+	}
+	fw.pending = false
+	fw.rc.Flush()
+}
+
+func (fw *delayedFlushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.pending = false
+	if fw.t != nil {
+		fw.t.Stop()
+	}
+}
@@ -0,0 +1,27 @@
+package uwsgi
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStreamResponse(t *testing.T) {
+	for _, tc := range []struct {
+		header http.Header
+		want   bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"Content-Type": {"text/html"}}, false},
+		{http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}}, true},
+		{http.Header{"Content-Type": {"application/grpc-web"}}, true},
+		{http.Header{"Content-Type": {"application/grpc-web+proto"}}, true},
+		{http.Header{"Content-Type": {"application/grpc-web-text"}}, true},
+		{http.Header{"Content-Type": {"multipart/x-mixed-replace; boundary=x"}}, true},
+		{http.Header{"Content-Type": {"text/html"}, "X-Accel-Buffering": {"no"}}, true},
+		{http.Header{"Content-Type": {"text/event-stream"}, "X-Accel-Buffering": {"yes"}}, false},
+	} {
+		if got := streamResponse(tc.header); got != tc.want {
+			t.Errorf("streamResponse(%v) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package uwsgi
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Tenant describes an application served by TenantRouter.
+type Tenant struct {
+	// Handler serves requests for the tenant, usually it's a Proxy
+	// connecting to tenant's backend.
+	Handler http.Handler
+
+	// AppID, if set, is passed to the backend as UWSGI_APPID variable.
+	AppID string
+
+	// Mount, if set, is the path prefix the application is mounted at: it's
+	// passed to the backend as SCRIPT_NAME variable and stripped from
+	// PATH_INFO. It's also passed as X-Forwarded-Prefix header, appended to
+	// the prefix from the incoming header of the same name if present and
+	// trusted (see Proxy.ForwardedTrust), for applications relying on it to
+	// generate URLs (like Werkzeug's ProxyFix).
+	Mount string
+}
+
+// TenantRouter is a http.Handler routing requests of multiple tenants to
+// their own backends. Tenant key is extracted from request with the Key
+// function (see TenantByHostSuffix, TenantByHeader, TenantByPathPrefix) and
+// passed to the backend as HTTP_X_TENANT variable, X-Tenant header sent by
+// client is discarded. Requests for unknown tenants get 404 Not Found reply.
+//
+// Tenants table can be updated at runtime with Set, Delete, and Replace
+// methods.
+type TenantRouter struct {
+	Key func(*http.Request) string
+
+	mu      sync.RWMutex
+	tenants map[string]Tenant
+}
+
+// Set adds or replaces tenant with the given key.
+func (tr *TenantRouter) Set(key string, t Tenant) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.tenants == nil {
+		tr.tenants = make(map[string]Tenant)
+	}
+	tr.tenants[key] = t
+}
+
+// get returns tenant with the given key.
+func (tr *TenantRouter) get(key string) (Tenant, bool) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	t, ok := tr.tenants[key]
+	return t, ok
+}
+
+// Delete removes tenant with the given key.
+func (tr *TenantRouter) Delete(key string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	delete(tr.tenants, key)
+}
+
+// Replace replaces the whole tenants table.
+func (tr *TenantRouter) Replace(tenants map[string]Tenant) {
+	m := make(map[string]Tenant, len(tenants))
+	for k, v := range tenants {
+		m[k] = v
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.tenants = m
+}
+
+func (tr *TenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := tr.Key(r)
+	tr.mu.RLock()
+	t, ok := tr.tenants[key]
+	tr.mu.RUnlock()
+	if !ok || key == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if _, ok := r.Header["X-Tenant"]; ok {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Header = r.Header.Clone()
+		r2.Header.Del("X-Tenant")
+		r = r2
+	}
+	vars := []Var{{"HTTP_X_TENANT", key}}
+	if t.AppID != "" {
+		vars = append(vars, Var{"UWSGI_APPID", t.AppID})
+	}
+	r = WithTrace(WithVars(r, vars...), "tenant", key)
+	if t.Mount != "" {
+		r = withMount(r, strings.TrimSuffix(t.Mount, "/"))
+	}
+	t.Handler.ServeHTTP(w, r)
+}
+
+// TenantByHostSuffix returns function extracting tenant key from the Host
+// header of requests to subdomains of the given domain: for domain
+// "example.com", request to "acme.example.com" has "acme" tenant key.
+func TenantByHostSuffix(domain string) func(*http.Request) string {
+	suffix := "." + strings.ToLower(strings.Trim(domain, "."))
+	return func(r *http.Request) string {
+		host := hostname(r.Host)
+		if !strings.HasSuffix(host, suffix) {
+			return ""
+		}
+		return strings.TrimSuffix(host, suffix)
+	}
+}
+
+// TenantByHeader returns function using value of the given request header as
+// tenant key.
+func TenantByHeader(name string) func(*http.Request) string {
+	return func(r *http.Request) string { return r.Header.Get(name) }
+}
+
+// TenantByPathPrefix returns function using the first segment of request path
+// as tenant key: request to "/acme/index.html" has "acme" tenant key. Such
+// tenants usually have Mount field set to "/" + key.
+func TenantByPathPrefix() func(*http.Request) string {
+	return func(r *http.Request) string {
+		s := strings.TrimPrefix(r.URL.Path, "/")
+		if i := strings.IndexByte(s, '/'); i != -1 {
+			s = s[:i]
+		}
+		return s
+	}
+}
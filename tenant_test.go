@@ -0,0 +1,125 @@
+package uwsgi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestTenantRouter(t *testing.T) {
+	acme := &testBackend{handle: okResponse}
+	other := &testBackend{handle: okResponse}
+	tr := &TenantRouter{Key: TenantByPathPrefix()}
+	tr.Set("acme", Tenant{Handler: &Proxy{DialContext: acme.dial}, Mount: "/acme/", AppID: "acme-app"})
+	tr.Set("other", Tenant{Handler: &Proxy{DialContext: other.dial}})
+	for _, tc := range []struct {
+		path string
+		code int
+		be   *testBackend
+		vars map[string]string
+	}{
+		{"/acme/index.html", http.StatusOK, acme, map[string]string{
+			"HTTP_X_TENANT": "acme",
+			"UWSGI_APPID":   "acme-app",
+			"SCRIPT_NAME":   "/acme",
+			"PATH_INFO":     "/index.html",
+		}},
+		{"/other/x", http.StatusOK, other, map[string]string{
+			"HTTP_X_TENANT": "other",
+			"UWSGI_APPID":   "",
+			"PATH_INFO":     "/other/x",
+		}},
+		{"/unknown/x", http.StatusNotFound, nil, nil},
+		{"/", http.StatusNotFound, nil, nil},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Header.Set("X-Tenant", "spoofed")
+		w := httptest.NewRecorder()
+		tr.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Fatalf("%s: got status %d, want %d", tc.path, w.Code, tc.code)
+		}
+		if tc.be == nil {
+			continue
+		}
+		vars := tc.be.lastVars()
+		for k, want := range tc.vars {
+			if got := vars[k]; got != want {
+				t.Errorf("%s: got %s=%q, want %q", tc.path, k, got, want)
+			}
+		}
+		if r.Header.Get("X-Tenant") != "spoofed" {
+			t.Errorf("%s: request headers of the caller are modified", tc.path)
+		}
+	}
+	tr.Delete("other")
+	w := httptest.NewRecorder()
+	tr.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other/x", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("deleted tenant: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestTenantKeys(t *testing.T) {
+	byHost := TenantByHostSuffix(".Example.com.")
+	byHeader := TenantByHeader("X-Customer")
+	for _, tc := range []struct {
+		host, header, path string
+		fn                 func(*http.Request) string
+		want               string
+	}{
+		{host: "acme.example.com", fn: byHost, want: "acme"},
+		{host: "ACME.Example.COM:8080", fn: byHost, want: "acme"},
+		{host: "a.b.example.com.", fn: byHost, want: "a.b"},
+		{host: "example.com", fn: byHost, want: ""},
+		{host: "acme.example.org", fn: byHost, want: ""},
+		{header: "acme", fn: byHeader, want: "acme"},
+		{path: "/acme", fn: TenantByPathPrefix(), want: "acme"},
+		{path: "/acme/x/y", fn: TenantByPathPrefix(), want: "acme"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://x/", nil)
+		r.Host = tc.host
+		if tc.path != "" {
+			r.URL.Path = tc.path
+		}
+		if tc.header != "" {
+			r.Header.Set("X-Customer", tc.header)
+		}
+		if got := tc.fn(r); got != tc.want {
+			t.Errorf("host %q, header %q, path %q: got key %q, want %q",
+				tc.host, tc.header, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestTenantRouterConcurrent(t *testing.T) {
+	b := &testBackend{handle: okResponse}
+	h := &Proxy{DialContext: b.dial}
+	tr := &TenantRouter{Key: TenantByHeader("X-Customer")}
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				tr.Set("acme", Tenant{Handler: h})
+				tr.Delete("acme")
+				tr.Replace(map[string]Tenant{"acme": {Handler: h, AppID: "app"}})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("X-Customer", "acme")
+				w := httptest.NewRecorder()
+				tr.ServeHTTP(w, r)
+				if w.Code != http.StatusOK && w.Code != http.StatusNotFound {
+					t.Errorf("goroutine %d: got status %d", i, w.Code)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,57 @@
+package uwsgi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// idleReader reads from conn extending its read deadline by d before each
+// read, so that reading only times out if no data arrives for d, or once
+// deadline passes. Zero d or deadline means no limit.
+type idleReader struct {
+	conn     net.Conn
+	d        time.Duration
+	deadline time.Time
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(earliest(r.deadline, timeoutAt(r.d))); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(b)
+}
+
+// aLongTimeAgo is a deadline that makes pending I/O fail right away.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// abortOnDone makes pending and future I/O on conn fail once ctx is done.
+// Calling stop stops this, it returns false if conn has already been
+// aborted; see context.AfterFunc.
+func abortOnDone(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() { conn.SetDeadline(aLongTimeAgo) })
+}
+
+// timeoutAt returns time d from now, or zero time if d is not positive.
+func timeoutAt(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// earliest returns the earliest of non-zero times a and b, or zero time if
+// both are zero.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || !b.IsZero() && b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// isTimeout reports whether err is a timeout error.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,50 @@
+package uwsgi
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+)
+
+// tlsVars returns variables describing TLS connection, see Proxy.TLSVars and
+// Proxy.TLSClientCert.
+func tlsVars(cs *tls.ConnectionState, withCert bool) []Var {
+	vars := []Var{
+		{"SSL_PROTOCOL", tlsVersionName(cs.Version)},
+		{"SSL_CIPHER", tls.CipherSuiteName(cs.CipherSuite)},
+	}
+	if cs.ServerName != "" {
+		vars = append(vars, Var{"SSL_SERVER_NAME", cs.ServerName})
+	}
+	if cs.DidResume {
+		vars = append(vars, Var{"SSL_SESSION_REUSED", "r"})
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return vars
+	}
+	cert := cs.PeerCertificates[0]
+	vars = append(vars,
+		Var{"SSL_CLIENT_S_DN", cert.Subject.String()},
+		Var{"SSL_CLIENT_I_DN", cert.Issuer.String()},
+	)
+	if withCert {
+		vars = append(vars, Var{"SSL_CLIENT_CERT",
+			string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))})
+	}
+	return vars
+}
+
+// tlsVersionName returns name of TLS version as OpenSSL reports it, like
+// "TLSv1.3".
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return tls.VersionName(v)
+}
@@ -0,0 +1,63 @@
+package uwsgi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// WithTrace returns a shallow copy of r with its context carrying a decision
+// taken about the request, like the route it matched, to be included in the
+// trace Proxy passes to the backend, see Proxy.TraceVar. Routers of this
+// package record their decisions this way; name should be a short token,
+// value may be arbitrary.
+func WithTrace(r *http.Request, name, value string) *http.Request {
+	old := ctxTrace(r.Context())
+	all := make([]Var, 0, len(old)+1)
+	all = append(append(all, old...), Var{name, value})
+	return r.WithContext(context.WithValue(r.Context(), traceKey, all))
+}
+
+func ctxTrace(ctx context.Context) []Var {
+	steps, _ := ctx.Value(traceKey).([]Var)
+	return steps
+}
+
+// requestTrace collects decisions Proxy takes about the request, see
+// Proxy.TraceVar.
+type requestTrace struct {
+	steps    []Var // recorded with WithTrace
+	mount    string
+	rewrites []string
+}
+
+// encode returns trace with backend connection details appended, encoded
+// like URL query, so it can be parsed with standard tools, e.g.
+// "tenant=acme&mount=%2Fapp&rewrite=path%2Cmethod&backend=10.0.0.1%3A3031&retries=1".
+func (t *requestTrace) encode(backend string, retries int) string {
+	var b strings.Builder
+	add := func(name, value string) {
+		if b.Len() != 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(url.QueryEscape(name))
+		b.WriteByte('=')
+		b.WriteString(url.QueryEscape(value))
+	}
+	for _, s := range t.steps {
+		add(s.Name, s.Value)
+	}
+	if t.mount != "" {
+		add("mount", t.mount)
+	}
+	if len(t.rewrites) != 0 {
+		add("rewrite", strings.Join(t.rewrites, ","))
+	}
+	add("backend", backend)
+	if retries > 0 {
+		add("retries", strconv.Itoa(retries))
+	}
+	return b.String()
+}
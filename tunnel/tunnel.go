@@ -0,0 +1,50 @@
+// Package tunnel provides uwsgi.DialFunc constructors reaching uWSGI backends
+// through SOCKS5 proxies or SSH connections, which is useful for tools
+// talking to private backend sockets in remote environments.
+package tunnel
+
+import (
+	"context"
+	"net"
+
+	"github.com/artyom/uwsgi"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS5 returns DialFunc connecting to the backend address on the named
+// network ("tcp" or its variants) through SOCKS5 proxy at proxyAddr, which
+// is a host:port pair. Auth may be nil if proxy requires no authentication.
+func SOCKS5(proxyAddr string, auth *proxy.Auth, network, address string) (uwsgi.DialFunc, error) {
+	d, err := proxy.SOCKS5("tcp", proxyAddr, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return func(context.Context) (net.Conn, error) { return d.Dial(network, address) }, nil
+	}
+	return func(ctx context.Context) (net.Conn, error) {
+		return cd.DialContext(ctx, network, address)
+	}, nil
+}
+
+// SSH returns DialFunc connecting to the backend address on the named network
+// through SSH connection: "tcp" network uses port forwarding, "unix" network
+// uses unix socket forwarding (OpenSSH streamlocal extension), so remote
+// socket paths can be used as is:
+//
+//	client, err := ssh.Dial("tcp", "bastion.example.com:22", config)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer client.Close()
+//	dial := tunnel.SSH(client, "unix", "/run/uwsgi/app.socket")
+//
+// Client is not closed by DialFunc, and once it's closed or broken, DialFunc
+// returns errors.
+func SSH(client *ssh.Client, network, address string) uwsgi.DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		return client.DialContext(ctx, network, address)
+	}
+}
@@ -0,0 +1,170 @@
+package uwsgi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// upgradeProtocol returns protocol client asks to switch to with the Upgrade
+// mechanism (like "websocket"), or empty string if r is a regular request.
+func upgradeProtocol(r *http.Request) string {
+	if r.ProtoMajor != 1 || !httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade") {
+		return ""
+	}
+	return r.Header.Get("Upgrade")
+}
+
+// errUpgradeIdle is reported for switched protocol connections closed after
+// UpgradeIdleTimeout.
+var errUpgradeIdle = errors.New("connection closed after idle timeout")
+
+// switchProtocols relays 101 Switching Protocols response read from br to
+// the client over its hijacked connection, then copies data between client
+// and backend in both directions until either side closes connection, or
+// until UpgradeIdleTimeout. With WebSocketPing set, it also pings WebSocket
+// clients.
+func (p *Proxy) switchProtocols(client net.Conn, brw *bufio.ReadWriter, resp *http.Response, backend net.Conn, br *bufio.Reader) error {
+	defer client.Close()
+	defer backend.Close()
+	if err := client.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if err := backend.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+	// data backend sent right after the response
+	early, _ := br.Peek(br.Buffered())
+	fromBackend := io.MultiReader(bytes.NewReader(early), backend)
+
+	var last atomic.Int64 // time of the last activity, UnixNano
+	last.Store(time.Now().UnixNano())
+	var mu sync.Mutex // serializes writes to client
+	toClient := &activityWriter{w: client, last: &last}
+	ping := p.WebSocketPing > 0 && strings.EqualFold(resp.Header.Get("Upgrade"), "websocket")
+
+	errc := make(chan error, 2)
+	go func() {
+		// brw may hold data client sent early
+		_, err := io.Copy(&activityWriter{w: backend, last: &last}, brw)
+		errc <- err
+	}()
+	go func() {
+		if ping {
+			errc <- copyFrames(toClient, fromBackend, &mu)
+			return
+		}
+		_, err := io.Copy(toClient, fromBackend)
+		errc <- err
+	}()
+	period := p.UpgradeIdleTimeout / 2
+	if ping && (period <= 0 || p.WebSocketPing < period) {
+		period = p.WebSocketPing
+	}
+	if period <= 0 {
+		return <-errc
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case now := <-ticker.C:
+			idle := now.Sub(time.Unix(0, last.Load()))
+			if p.UpgradeIdleTimeout > 0 && idle >= p.UpgradeIdleTimeout {
+				return errUpgradeIdle
+			}
+			if ping && idle >= p.WebSocketPing {
+				mu.Lock()
+				client.SetWriteDeadline(now.Add(p.WebSocketPing))
+				_, err := client.Write(wsPingFrame)
+				client.SetWriteDeadline(time.Time{})
+				mu.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// wsPingFrame is WebSocket ping frame with empty payload, as sent by server.
+var wsPingFrame = []byte{0x89, 0}
+
+// copyFrames copies WebSocket frames from src to dst until src is exhausted,
+// holding mu while each frame is written, so that other frames can be sent
+// between them.
+func copyFrames(dst io.Writer, src io.Reader, mu *sync.Mutex) error {
+	var hdr [14]byte // max frame header size
+	for {
+		if _, err := io.ReadFull(src, hdr[:2]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := 2
+		switch hdr[1] & 0x7f {
+		case 126:
+			n += 2
+		case 127:
+			n += 8
+		}
+		if hdr[1]&0x80 != 0 {
+			n += 4 // masking key
+		}
+		if _, err := io.ReadFull(src, hdr[2:n]); err != nil {
+			return err
+		}
+		var size int64
+		switch hdr[1] & 0x7f {
+		case 126:
+			size = int64(binary.BigEndian.Uint16(hdr[2:4]))
+		case 127:
+			size = int64(binary.BigEndian.Uint64(hdr[2:10]) & (1<<63 - 1))
+		default:
+			size = int64(hdr[1] & 0x7f)
+		}
+		mu.Lock()
+		_, err := dst.Write(hdr[:n])
+		if err == nil {
+			_, err = io.CopyN(dst, src, size)
+		}
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// activityWriter records time of each write to w in last.
+type activityWriter struct {
+	w    io.Writer
+	last *atomic.Int64
+}
+
+func (aw *activityWriter) Write(b []byte) (int, error) {
+	n, err := aw.w.Write(b)
+	if n > 0 {
+		aw.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
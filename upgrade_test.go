@@ -0,0 +1,70 @@
+package uwsgi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// dialUpgraded connects to srv and switches to WebSocket protocol, returning
+// connection and reader positioned after the response headers.
+func dialUpgraded(t *testing.T, srv *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	return conn, br
+}
+
+func switchingResponse(map[string]string, []byte) string {
+	return "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n" +
+		"\x81\x02hi" // text frame
+}
+
+func TestUpgradeIdleTimeout(t *testing.T) {
+	b := &testBackend{handle: switchingResponse, keepAlive: true}
+	srv := httptest.NewServer(&Proxy{DialContext: b.dial, UpgradeIdleTimeout: 50 * time.Millisecond})
+	defer srv.Close()
+	conn, br := dialUpgraded(t, srv)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("connection was not closed: %v", err)
+	}
+	if string(got) != "\x81\x02hi" {
+		t.Fatalf("got %q, want frame sent by backend", got)
+	}
+}
+
+func TestWebSocketPing(t *testing.T) {
+	b := &testBackend{handle: switchingResponse, keepAlive: true}
+	srv := httptest.NewServer(&Proxy{DialContext: b.dial, WebSocketPing: 20 * time.Millisecond})
+	defer srv.Close()
+	conn, br := dialUpgraded(t, srv)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	want := append([]byte("\x81\x02hi"), wsPingFrame...)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,45 @@
+package uwsgi
+
+import "strings"
+
+// Device classes returned by ClassifyDevice.
+const (
+	DeviceBot     = "bot"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+)
+
+// ClassifyDevice returns class of the device sending requests with the given
+// User-Agent header: DeviceBot, DeviceMobile, DeviceTablet, or
+// DeviceDesktop. It's a cheap heuristic based on common substrings, meant
+// for coarse decisions like picking a page layout or a cache key, not for
+// security checks: User-Agent is set by the client. Requests without
+// User-Agent are classified as bots. See Proxy.DeviceClass.
+func ClassifyDevice(userAgent string) string {
+	if userAgent == "" {
+		return DeviceBot
+	}
+	ua := strings.ToLower(userAgent)
+	for _, s := range botSignatures {
+		if strings.Contains(ua, s) {
+			return DeviceBot
+		}
+	}
+	switch {
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"),
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"),
+		strings.Contains(ua, "ipod"), strings.Contains(ua, "windows phone"):
+		return DeviceMobile
+	}
+	return DeviceDesktop
+}
+
+// botSignatures are lowercase substrings of User-Agent headers commonly
+// sent by crawlers, monitoring tools, and HTTP libraries.
+var botSignatures = []string{
+	"bot", "crawl", "spider", "slurp", "facebookexternalhit",
+	"curl/", "wget/", "python-requests", "go-http-client", "headless",
+}
@@ -0,0 +1,63 @@
+package uwsgi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClassifyDevice(t *testing.T) {
+	for _, tc := range []struct {
+		ua, want string
+	}{
+		{"", DeviceBot},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", DeviceBot},
+		{"Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", DeviceBot},
+		{"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", DeviceBot},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", DeviceBot},
+		{"curl/8.5.0", DeviceBot},
+		{"Wget/1.21.4", DeviceBot},
+		{"python-requests/2.31.0", DeviceBot},
+		{"Go-http-client/1.1", DeviceBot},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0 Safari/537.36", DeviceBot},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1", DeviceMobile},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36", DeviceMobile},
+		{"Mozilla/5.0 (Android 14; Mobile; rv:121.0) Gecko/121.0 Firefox/121.0", DeviceMobile},
+		{"Mozilla/5.0 (Windows Phone 10.0; Android 6.0.1; Microsoft; Lumia 950) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/52.0 Mobile Safari/537.36 Edge/15.15063", DeviceMobile},
+		{"Mozilla/5.0 (iPod touch; CPU iPhone OS 15_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko)", DeviceMobile},
+		{"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.6 Mobile/15E148 Safari/604.1", DeviceTablet},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36", DeviceTablet},
+		{"Mozilla/5.0 (Android 13; Tablet; rv:121.0) Gecko/121.0 Firefox/121.0", DeviceTablet},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36", DeviceDesktop},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_1) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15", DeviceDesktop},
+		{"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", DeviceDesktop},
+	} {
+		if got := ClassifyDevice(tc.ua); got != tc.want {
+			t.Errorf("ClassifyDevice(%q) = %q, want %q", tc.ua, got, tc.want)
+		}
+	}
+}
+
+func TestDeviceClassVar(t *testing.T) {
+	for _, tc := range []struct {
+		ua, want string
+	}{
+		{ua: "curl/8.5.0", want: DeviceBot},
+		{ua: "Mozilla/5.0 (Windows NT 10.0; Win64; x64)", want: ""}, // omitted
+	} {
+		b := &testBackend{handle: okResponse}
+		p := &Proxy{DialContext: b.dial, DeviceClass: func(ua string) string {
+			if c := ClassifyDevice(ua); c != DeviceDesktop {
+				return c
+			}
+			return ""
+		}}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("User-Agent", tc.ua)
+		r.Header.Set("X-Device-Class", "spoofed")
+		p.ServeHTTP(httptest.NewRecorder(), r)
+		if got := b.lastVars()["HTTP_X_DEVICE_CLASS"]; got != tc.want {
+			t.Errorf("%q: got HTTP_X_DEVICE_CLASS %q, want %q", tc.ua, got, tc.want)
+		}
+	}
+}
@@ -6,13 +6,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/textproto"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"unicode"
 )
@@ -39,159 +46,1345 @@ import (
 //	PATH_INFO
 //	SERVER_PROTOCOL
 //	SERVER_NAME — value from the "Host:" header
-//	HTTPS — only set to "on" if request has https scheme or
-//		X-Forwarded-Proto: https header
-//	SERVER_PORT — set to "443" if request has https scheme or
-//		X-Forwarded-Proto: https header
+//	HTTPS — only set to "on" if request was received over TLS, has https
+//		scheme or X-Forwarded-Proto: https header from a trusted peer (see
+//		Proxy.ForwardedTrust)
+//	SERVER_PORT — set to "443" if request was received over TLS, has https
+//		scheme or X-Forwarded-Proto: https header from a trusted peer
+//	REQUEST_SCHEME — "https" under the same conditions as HTTPS, "http"
+//		otherwise
+//	SERVER_ADDR — address of the listener that accepted the request, if
+//		can be detected
 //	REMOTE_ADDR — either address of connected peer, or leftmost value from
-//		X-Forwarded-For header if present
+//		X-Forwarded-For header if it is a valid IP address
 //	REMOTE_PORT — port of connected peer, if can be detected
 //
 // Note the REMOTE_ADDR variable is populated from X-Forwarded-For if present
 // — if server is exposed directly to the public network you may want to ensure
-// this header is cleared before passing request to this Handler.
+// this header is cleared before passing request to this Handler, or use Proxy
+// with TrustedProxies set.
 type Handler func(context.Context) (net.Conn, error)
 
 func (dial Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logf := logFunc(r)
+	(&Proxy{DialContext: dial}).ServeHTTP(w, r)
+}
+
+// Proxy is a http.Handler that proxies requests to an uWSGI backend. It works
+// the same way as Handler, but allows additional configuration.
+//
+// Proxy uses http.ResponseController to access optional ResponseWriter
+// features like flushing, so they're found through middleware that wraps
+// ResponseWriter, as long as wrappers implement
+//
+//	Unwrap() http.ResponseWriter
+//
+// method. Without it, streaming responses are buffered.
+//
+// HTTP/1.1 requests asking to switch protocols with the Upgrade header, like
+// WebSocket handshakes, are passed to the backend with their Connection and
+// Upgrade headers. If backend replies with 101 Switching Protocols, Proxy
+// hijacks client connection and relays data between client and backend in
+// both directions until either side closes connection, or until
+// UpgradeIdleTimeout.
+type Proxy struct {
+	// DialContext is used to connect to uWSGI backend, it must be set.
+	DialContext func(context.Context) (net.Conn, error)
+
+	// ErrorLog specifies logger for errors that happen while proxying
+	// requests. If nil, errors are logged with ErrorLog of http.Server
+	// handling the request, if it has one.
+	ErrorLog *log.Logger
+
+	// ResponseFilters, if set, are applied to the response body before it's
+	// copied to the client: each filter wraps the reader returned by the
+	// previous one, so the body can be rewritten on the fly without
+	// buffering. Filters see the body as sent by the backend, so they may
+	// need to handle Content-Encoding. Since filters may change body length,
+	// Content-Length response header is dropped if any filter is set.
+	ResponseFilters []func(io.Reader) io.Reader
+
+	// RequestFilters, if set, are applied to the request body before it's
+	// sent to the backend, in the same way as ResponseFilters. Since uWSGI
+	// requires CONTENT_LENGTH to be known upfront, filtered body is read
+	// completely before contacting the backend: up to SpoolMemory bytes are
+	// kept in memory, larger bodies are spooled to a temporary file.
+	RequestFilters []func(io.Reader) io.Reader
+
+	// SpoolMemory is the max number of bytes of request body kept in
+	// memory when it has to be read in full; if zero, 1 MiB is used.
+	SpoolMemory int64
+
+	// PostBuffering, if positive, enables offloading of request bodies that
+	// are larger than this number of bytes (or have unknown size) to
+	// temporary files created in PostBufferingDir. Such body is not sent to
+	// the backend, instead the name of the file is passed in the
+	// PostBufferingVar variable (UWSGI_POSTFILE if empty), and CONTENT_LENGTH
+	// holds the size of the file, which uWSGI needs to bound reads of the
+	// body. Smaller bodies are sent as usual.
+	//
+	// Backend must have access to the same filesystem and permissions to
+	// read the file; the file is removed once request is complete.
+	//
+	// If PostBuffering is set, it is used instead of SpoolMemory for
+	// bodies processed by RequestFilters.
+	PostBuffering    int64
+	PostBufferingDir string
+	PostBufferingVar string
+
+	// RequestTimeVars makes Proxy pass the time request was received at:
+	// REQUEST_TIME in whole seconds since the Unix epoch, REQUEST_TIME_FLOAT
+	// with microsecond precision, like PHP does, and MSEC with millisecond
+	// precision, like nginx $msec variable.
+	RequestTimeVars bool
+
+	// TLSVars makes Proxy pass details of TLS connection request was
+	// received over, like nginx does: SSL_PROTOCOL (e.g. "TLSv1.3"),
+	// SSL_CIPHER (IANA name of cipher suite, e.g. "TLS_AES_128_GCM_SHA256",
+	// which differs from OpenSSL naming), SSL_SERVER_NAME (SNI, if sent),
+	// and SSL_SESSION_REUSED ("r" if session was resumed). If client
+	// presented a certificate (see tls.Config.ClientAuth), its subject and
+	// issuer distinguished names are passed as SSL_CLIENT_S_DN and
+	// SSL_CLIENT_I_DN, and with TLSClientCert also set, the certificate
+	// itself is passed in PEM format as SSL_CLIENT_CERT. Certificate may
+	// take a few kilobytes, so backend buffer size may need to be increased,
+	// see BufferSize.
+	TLSVars       bool
+	TLSClientCert bool
+
+	// TraceVar, if set, is the name of variable (like X_PROXY_TRACE)
+	// summarizing decisions taken about the request, for application logs
+	// to tie them to the proxy side: tenant or host it was routed by (see
+	// TenantRouter, HostRouter, and WithTrace), whether HostRouter found
+	// its backend cached, path prefix application is mounted at, rewrites
+	// of path (see NormalizePath) and method (see MethodOverride), address
+	// of the backend, and the number of times request was resent (see
+	// RetryBudget). Value is encoded like URL query:
+	//
+	//	host=example.com&cache=hit&rewrite=path&backend=%2Frun%2Fapp.sock
+	//
+	// It's not used with ProtocolHTTP backends.
+	TraceVar string
+
+	// GeoIP, if set, is used to locate the client by its address (see
+	// ClientIP) and pass GEOIP_COUNTRY_CODE and GEOIP_CITY variables to the
+	// backend, like nginx geoip module does. Variables are omitted if
+	// location is unknown. See MaxMind.
+	GeoIP GeoIP
+
+	// DeviceClass, if set, classifies client by its User-Agent header; the
+	// result is passed to the backend as HTTP_X_DEVICE_CLASS variable, as
+	// if it was sent in X-Device-Class request header (which is dropped if
+	// client sends it). Empty result omits the variable. See
+	// ClassifyDevice.
+	DeviceClass func(userAgent string) string
+
+	// MountPoint, if set, is the path prefix the application is mounted at,
+	// like "/app". It's passed to the backend as SCRIPT_NAME variable and
+	// stripped from PATH_INFO, so that WSGI applications generate correct
+	// URLs. Proxy may be used both with and without http.StripPrefix: if
+	// request path doesn't start with MountPoint, it's considered already
+	// stripped, and the prefix is restored in REQUEST_URI. Mount point set
+	// by TenantRouter takes precedence. It's also passed as X-Forwarded-Prefix
+	// header, appended to the prefix from the incoming header of the same
+	// name if headers from the peer are trusted (see ForwardedTrust). Not
+	// used with ProtocolHTTP.
+	MountPoint string
+
+	// Modifier1 and Modifier2 are set in the header of uwsgi packets sent to
+	// the backend. uWSGI uses modifier1 to pick the plugin handling the
+	// request: 0 (the default) is WSGI, other common values are 5 for
+	// PSGI, 6 for Lua, 7 for Rack, 9 for CGI, and 14 for PHP; see uWSGI
+	// documentation for the full list. Modifier2 is rarely used, its
+	// meaning depends on the plugin. Not used with ProtocolHTTP.
+	Modifier1 uint8
+	Modifier2 uint8
+
+	// Protocol defines how requests are sent to the backend, by default
+	// uwsgi protocol is used.
+	Protocol Protocol
+	detected int32 // protocol detected for ProtocolAuto, plus one
+
+	// ModifyResponse, if set, is called with backend response before it's
+	// sent to the client, and may change response headers or replace its
+	// body; Content-Length header must then be updated or removed. Response
+	// Request field holds the client request. If it returns non-nil error,
+	// client gets reply with the status code from *StatusError, or 502 Bad
+	// Gateway status for other errors. See RewriteLocation,
+	// RewriteCookieDomain, and RewriteCookiePath.
+	ModifyResponse func(*http.Response) error
+
+	// ResponseHeaderDeny lists backend response headers that are removed
+	// before response is sent to the client, like internal debugging
+	// headers. ResponseHeaderAllow, if not empty, lists the only backend
+	// response headers that are passed to the client, so it has to include
+	// everything clients need, like Content-Type. Header names are
+	// case-insensitive, name ending with "*" matches by prefix:
+	//
+	//	p.ResponseHeaderDeny = []string{"X-Debug-*", "X-Runtime"}
+	//
+	// Headers added by Proxy itself (see SecurityHeaders) or by wrapping
+	// middleware are not affected. Policy also applies to 103 Early Hints
+	// responses.
+	ResponseHeaderAllow []string
+	ResponseHeaderDeny  []string
+
+	// DefaultContentType, if set, is used as Content-Type of backend
+	// responses that have none. Otherwise http.ResponseWriter detects
+	// content type from the first bytes of the body, which may be wrong for
+	// streamed responses. If DisableSniffing is set, such responses are sent
+	// without Content-Type.
+	DefaultContentType string
+	DisableSniffing    bool
+
+	// Passthrough guarantees that request parts commonly covered by request
+	// signatures (AWS SigV4, webhook HMACs) reach the backend unaltered:
+	// REQUEST_URI and QUERY_STRING hold the request target exactly as sent
+	// by the client, header values and request body are not modified.
+	// NormalizePath, MethodOverride, and RequestFilters alter these parts,
+	// so setting them with Passthrough is a configuration error reported
+	// by Validate; if Validate is not called, they're not applied. It also
+	// disables rewriting of forwarding headers (see ForwardedHeaders and
+	// ForwardedTrust) and X-Forwarded-Prefix. With MountPoint set,
+	// SCRIPT_NAME and PATH_INFO are set as usual, while REQUEST_URI still
+	// holds the request target as sent by the client, including the prefix.
+	// Note that hop-by-hop headers are still removed, and multiple header
+	// lines with the same name are joined with ", ", which signature
+	// schemes account for when canonicalizing headers.
+	Passthrough bool
+
+	// NginxCompat makes Proxy pass the same set of variables, in the same
+	// order, as nginx does with its stock uwsgi_params file, so that
+	// applications migrated from behind nginx see the same environment:
+	// DOCUMENT_ROOT, REQUEST_SCHEME, SERVER_ADDR, and HTTP_HOST are added,
+	// HTTPS is only set when request is received over TLS, SERVER_NAME and
+	// SERVER_PORT come from the host name and the listener port,
+	// CONTENT_LENGTH is empty for requests without body, and
+	// HTTP_CONNECTION is not overridden.
+	NginxCompat bool
+
+	// DocumentRoot is the value of DOCUMENT_ROOT variable passed in
+	// NginxCompat mode, nginx "root" directive counterpart.
+	DocumentRoot string
+
+	// SecurityHeaders, if set, are added to backend responses unless backend
+	// has already set them. See RecommendedSecurityHeaders.
+	SecurityHeaders http.Header
+
+	// RedirectHTTPS makes Proxy redirect plain HTTP requests to the same URL
+	// with https scheme without contacting the backend.
+	RedirectHTTPS bool
+
+	// CanonicalHost, if set, makes Proxy redirect requests with a different
+	// Host header to the same URL on this host without contacting the
+	// backend. It may include port.
+	//
+	// Redirects use 301 status for GET and HEAD requests, and 308 status for
+	// other methods.
+	CanonicalHost string
+
+	// NormalizePath enables normalization of request path before it's
+	// passed to the backend: duplicate slashes are collapsed, "." and ".."
+	// segments are resolved, and REQUEST_URI is rebuilt accordingly.
+	// Requests with encoded slashes or dot segments in path are rejected.
+	// This ensures backend routes request by the same path as Go code in
+	// front of the Proxy.
+	NormalizePath bool
+
+	// MethodOverride is a list of methods that POST requests are allowed to
+	// override REQUEST_METHOD with, using either X-HTTP-Method-Override
+	// header or _method field of url-encoded form, for clients behind
+	// firewalls that only allow GET and POST. Forms are only checked if
+	// request body is not larger than SpoolMemory.
+	MethodOverride []string
+
+	// AllowedMethods, if not empty, is the list of methods requests may
+	// use, including methods set with MethodOverride. Other requests are
+	// rejected with 405 Method Not Allowed status and Allow header listing
+	// these methods, without contacting the backend.
+	AllowedMethods []string
+
+	// OptionsAsterisk, Trace and UnknownMethods define how "OPTIONS *",
+	// TRACE, and requests with methods not defined by RFC 9110 or RFC 5789
+	// are handled. OPTIONS * requests passed to the backend have empty
+	// PATH_INFO.
+	OptionsAsterisk MethodPolicy
+	Trace           MethodPolicy
+	UnknownMethods  MethodPolicy
+
+	// ResponseIdleTimeout, if positive, limits how long Proxy waits for the
+	// next chunk of response from the backend. Unlike absolute deadline,
+	// this allows long streaming responses, while still detecting backends
+	// that hang. If backend fails to send response headers in time, client
+	// gets 504 Gateway Timeout status.
+	ResponseIdleTimeout time.Duration
+
+	// ResponseHeaderTimeout, if positive, limits how long Proxy waits for
+	// backend response headers once request is sent. WriteTimeout, if
+	// positive, limits how long sending request to the backend may take,
+	// including request body, so slow client uploads count against it.
+	// Timeout, if positive, limits the whole request handling, from its
+	// arrival to the end of response. When any of them is exceeded before
+	// response headers are received, client gets 504 Gateway Timeout
+	// status, or 408 Request Timeout if it's the client that was too slow
+	// sending request body; if Timeout is exceeded while response body is
+	// copied, the response is cut short. Only timeouts caused by the
+	// backend count as its failures (see MaxFails).
+	ResponseHeaderTimeout time.Duration
+	WriteTimeout          time.Duration
+	Timeout               time.Duration
+
+	// UpgradeIdleTimeout, if positive, closes connections switched to another
+	// protocol, like WebSocket, once neither side has sent anything for that
+	// long, so that dead clients don't hold backend connections forever.
+	//
+	// WebSocketPing, if positive, is how often Proxy sends WebSocket ping
+	// frames to the client over connection with no traffic. Live clients
+	// reply with pong frames, which are relayed to the backend (that has to
+	// ignore them, as RFC 6455 requires for unsolicited pongs) and count as
+	// activity, so with both set, UpgradeIdleTimeout only drops dead
+	// clients; it should be a few times longer than WebSocketPing. Pings
+	// also keep NAT and load balancer mappings alive.
+	UpgradeIdleTimeout time.Duration
+	WebSocketPing      time.Duration
+
+	// FlushInterval controls how often response body is flushed to the
+	// client while it's being copied from the backend. If zero, no periodic
+	// flushing is done; negative value means flushing after each write.
+	// Responses that are meant to be streamed, like Server-Sent Events or
+	// responses with "X-Accel-Buffering: no" header, are always flushed
+	// after each write.
+	FlushInterval time.Duration
+
+	// VarMapper, if set, is called for each request, and variables it
+	// returns are appended to those set by Proxy, which allows passing
+	// request-specific information like tenant ID or feature flags to
+	// the backend.
+	VarMapper func(*http.Request) []Var
+
+	// ClientIPHeaders is a list of request headers to take client address
+	// for REMOTE_ADDR from, in order of precedence: the first header with
+	// a valid IP address wins, peer address is used if there's none.
+	// Supported headers are "X-Forwarded-For", "Forwarded" (RFC 7239, "for"
+	// parameters), both holding a chain of addresses an entry is selected
+	// from with ForwardedStrategy, and "X-Real-IP". If nil, only
+	// X-Forwarded-For is used; set it to an empty non-nil slice to always
+	// use peer address.
+	ClientIPHeaders []string
+
+	// ForwardedStrategy selects client address from X-Forwarded-For and
+	// Forwarded header chains listed in ClientIPHeaders. If nil,
+	// ForwardedFirst is used. It's not used in TrustFirstUntrusted mode.
+	ForwardedStrategy ForwardedStrategy
+
+	// TrustedProxies lists networks of proxies trusted to pass client
+	// address in ClientIPHeaders, see ForwardedTrust.
+	TrustedProxies []netip.Prefix
+
+	// ForwardedTrust defines when ClientIPHeaders are honored. If zero,
+	// TrustFirstUntrusted is used if TrustedProxies is set, and
+	// TrustAlways otherwise. In modes other than TrustAlways, peer address
+	// is appended to X-Forwarded-For chain passed to the backend as
+	// HTTP_X_FORWARDED_FOR, or replaces the chain if it's not trusted.
+	ForwardedTrust TrustMode
+
+	// ForwardedHeaders makes Proxy describe its hop in forwarding headers
+	// passed to the backend (as HTTP_X_FORWARDED_FOR and other variables):
+	// peer address is appended to X-Forwarded-For chain, element with
+	// peer address, Host, and scheme is appended to Forwarded (RFC 7239)
+	// chain, and X-Forwarded-Proto and X-Forwarded-Host are set unless
+	// passed by the client. Headers from untrusted peers (see
+	// ForwardedTrust) are replaced rather than appended to. Not used with
+	// Passthrough.
+	ForwardedHeaders bool
+
+	// ModifyVars, if set, is called after variables for the request are
+	// constructed, before Admit, and may add, change, or remove any of
+	// them, including those set by Proxy. If it returns non-nil error,
+	// request is rejected: with the status code from *StatusError, 431
+	// Request Header Fields Too Large status for ErrVarsTooLarge, or 500
+	// Internal Server Error status for other errors. Not used with
+	// ProtocolHTTP.
+	ModifyVars func(r *http.Request, vars *Vars) error
+
+	// Admit, if set, is called after variables for the request are
+	// constructed, right before connecting to the backend. It may modify
+	// vars. If it returns non-nil error, request is rejected: with the
+	// status code from *StatusError, 431 Request Header Fields Too Large
+	// status for ErrVarsTooLarge, or 403 Forbidden status for other errors.
+	Admit func(r *http.Request, vars *Vars) error
+
+	// SmallBodySize is the max size of request body which is read in full
+	// and sent to the backend in a single write with variables packet,
+	// saving syscalls and backend wakeups on typical API requests. If zero,
+	// 16 KiB is used; negative value disables this.
+	SmallBodySize int64
+
+	// BufferSize is the size of backend buffer for request variables, as
+	// set by uWSGI --buffer-size option (uWSGI default is 4096). Requests
+	// with variables that don't fit are rejected with 431 Request Header
+	// Fields Too Large status without contacting the backend. If zero, max
+	// uwsgi packet size of 65535 is assumed. Proxy serves a single
+	// application, so routes to applications with different buffer sizes
+	// use Proxy each, with its own BufferSize and MaxResponseHeaderBytes;
+	// see RouteConfig for routes applied at runtime.
+	BufferSize int
+
+	// ReadBufferSize is the size of buffer used to read responses from the
+	// backend; response header lines longer than that are read with extra
+	// allocations. Buffers are reused across requests. If zero, 4096 is
+	// used.
+	ReadBufferSize int
+
+	// MaxResponseHeaderBytes limits the size of backend response headers,
+	// including informational (1xx) responses preceding the final one, so
+	// that a buggy backend can't make Proxy buffer them without bound.
+	// Responses with larger headers are rejected with 502 Bad Gateway
+	// status. If zero, 1 MiB is used.
+	MaxResponseHeaderBytes int64
+
+	// DisconnectSignal, if positive, is the uWSGI signal number sent to the
+	// backend over a new connection when client disconnects before the
+	// response is delivered, so that application registering a handler for
+	// it (see uwsgi.register_signal) can abort expensive work. With
+	// Balancer, signal is sent to the backend serving the request. Since
+	// uWSGI signals carry no request reference, handler has to find out
+	// which work to abort on its own, e.g. by checking whether its clients
+	// are still connected. Not used with ProtocolHTTP backends.
+	DisconnectSignal int
+
+	// RetryBudget, if set, limits retries of backend connection attempts
+	// that failed with temporary errors, and resending of requests: if
+	// backend closes connection while request is being written to it,
+	// like uWSGI does when recycling workers, request is resent once over
+	// a new connection, possibly to another backend if DialContext is
+	// Balancer's. Only requests without body and with safe method (GET,
+	// HEAD, OPTIONS, TRACE) are resent, or those with body spooled because
+	// of RequestFilters or PostBuffering.
+	RetryBudget *RetryBudget
+
+	// JSONErrors makes Proxy render error responses it generates itself
+	// (like 502 Bad Gateway when backend is down) as JSON problem details
+	// (RFC 7807) instead of plain text, for deployments fronting JSON APIs.
+	// Such responses carry correlation ID, taken from the request header
+	// named by CorrelationHeader (X-Request-Id if empty) or generated
+	// randomly; it's also set in the response header of the same name.
+	JSONErrors        bool
+	CorrelationHeader string
+
+	// DialErrors, if set, overrides how backend connection errors of given
+	// kinds are handled. By default, attempts failing with DialOverloaded
+	// and DialTimeout errors (and other temporary errors) are retried, and
+	// end with 504 Gateway Timeout reply, other errors get 503 Service
+	// Unavailable reply right away. Log messages include error kind.
+	//
+	//	p.DialErrors = map[uwsgi.DialErrorKind]uwsgi.DialPolicy{
+	//		// wait for socket to reappear while backend restarts
+	//		uwsgi.DialNoSocket: {Status: http.StatusServiceUnavailable, Retry: true},
+	//		uwsgi.DialPermission: {Status: http.StatusInternalServerError},
+	//	}
+	DialErrors map[DialErrorKind]DialPolicy
+
+	// MaxFails, if positive, enables passive health checking of the
+	// backend: after that many consecutive failures to connect to the
+	// backend or to get response from it, backend is considered down for
+	// FailCooldown (10 seconds if zero), and requests get 503 Service
+	// Unavailable reply right away, without trying to reach it. Error
+	// responses sent by the application itself are not failures. See
+	// BackendStatus. With Balancer, use its MaxFails instead to eject
+	// individual backends.
+	MaxFails     int
+	FailCooldown time.Duration
+
+	// OnAbort, if set, is called by ServeHTTP for requests abandoned by the
+	// client before they were handled completely, right before ServeHTTP
+	// panics with http.ErrAbortHandler (if response was not started yet).
+	// Result tells which phase of exchange with the backend request has
+	// reached and its partial timings, so that aborted requests can be
+	// accounted for in logs and metrics.
+	OnAbort func(r *http.Request, res Result)
+
+	// Faults, if set, injects faults into exchanges with the backend.
+	Faults *FaultInjector
+
+	// MaxIdleConns, if positive, enables reuse of backend connections and
+	// limits the number of idle ones kept open. Backend must support
+	// persistent connections, e.g. uWSGI serving HTTP with --http-socket
+	// and --http-keepalive, used with ProtocolHTTP. Stock uwsgi protocol
+	// sockets close connection after each response, so there's nothing to
+	// reuse. Idle connections closed by the backend are detected and
+	// discarded before reuse where the platform allows it, as are idle
+	// connections to unix sockets since replaced by new socket files, e.g.
+	// when a new backend instance took over the socket path during deploy
+	// while the old one finishes serving existing connections.
+	MaxIdleConns int
+
+	// IdleConnTimeout is how long idle backend connection is kept for
+	// reuse. If zero, 90 seconds is used.
+	IdleConnTimeout time.Duration
+
+	// MaxConnAge and MaxConnRequests, if positive, retire reused backend
+	// connections once they've been open for that long or have served that
+	// many requests, so that connections follow backend worker recycling
+	// (see uWSGI --max-requests and --max-worker-lifetime options) instead
+	// of pinning long-lived workers.
+	MaxConnAge      time.Duration
+	MaxConnRequests int
+
+	// MaxConns, if positive, limits the number of backend connections in
+	// use at the same time; requests over the limit wait for a connection
+	// to be released. Waiting requests are served in order of their
+	// priority, then in order of arrival. The limit is shared by all
+	// backends; see Balancer.MaxConns for the limit per backend.
+	MaxConns int
+
+	// MaxConnWait, if positive, limits how long request waits for a backend
+	// connection when MaxConns is reached (see Result.Wait). Once it's
+	// exceeded, request gets 503 Service Unavailable reply, or, if
+	// ConnWaitOverflow is set, connects to the backend over MaxConns limit,
+	// trading extra backend load for bounded latency.
+	MaxConnWait      time.Duration
+	ConnWaitOverflow bool
+
+	// MaxQueue, if positive, limits the number of requests waiting for a
+	// backend connection when MaxConns is reached. Once queue is full,
+	// request with the lowest priority among the waiting ones and the new
+	// one is shed with 503 Service Unavailable status.
+	MaxQueue int
+
+	// Priority, if set, returns priority of the request: when requests
+	// have to wait for a backend connection (see MaxConns), those with
+	// higher priority are served first, and those with lower priority are
+	// shed first. This keeps health checks and admin endpoints responsive
+	// under load. Requests have priority 0 by default:
+	//
+	//	p.Priority = func(r *http.Request) int {
+	//		if r.URL.Path == "/healthz" {
+	//			return 1
+	//		}
+	//		return 0
+	//	}
+	Priority func(*http.Request) int
+
+	pool          connPool
+	mu            sync.Mutex
+	conns         map[net.Conn]struct{} // backend connections in use
+	draining      bool
+	drained       chan struct{} // closed once no conns are left while draining
+	schedule      []*scheduled
+	readOnly      bool
+	readOnlyRetry time.Duration // Retry-After in read-only mode
+	maintenance   bool
+	maintRetry    time.Duration // Retry-After in maintenance mode
+	fails         int           // consecutive backend failures
+	downUntil     time.Time     // backend is considered down until then
+	readers       sync.Pool     // of *bufio.Reader
+	logLevel      atomic.Int32  // LogLevel
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res := p.ServeHTTPResult(w, r)
+	if !errors.Is(res.Err, context.Canceled) {
+		return
+	}
+	if p.OnAbort != nil {
+		p.OnAbort(r, res)
+	}
+	if res.Status == 0 {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ServeHTTPResult handles request the same way as ServeHTTP, and returns
+// the Result describing how it was handled. It's meant to be used by
+// wrapping middleware that needs to know details of the exchange.
+//
+// Unlike ServeHTTP, it does not panic with http.ErrAbortHandler if client
+// goes away before the response is sent; returned Result has zero Status
+// and Err matching context.Canceled in this case.
+func (p *Proxy) ServeHTTPResult(w http.ResponseWriter, r *http.Request) Result {
+	res := Result{Start: time.Now()}
+	sw := &statusWriter{ResponseWriter: w}
+	p.serve(sw, r, &res)
+	res.Status, res.Bytes = sw.status, sw.written
+	res.Total = time.Since(res.Start)
+	p.logResult(r, res)
+	if rp, ok := r.Context().Value(resultKey).(*Result); ok {
+		*rp = res // for SLO
+	}
+	return res
+}
+
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request, res *Result) {
+	logf := p.logFunc(r)
+	if p.redirect(w, r) || p.applyMethodPolicy(w, r, res) {
+		return
+	}
+	if p.isDraining() {
+		p.replyError(w, r, res, http.StatusServiceUnavailable, "", errDraining)
+		return
+	}
+	if p.applySchedule(w, r, res) {
+		return
+	}
 	if r.Header.Get("Trailer") != "" {
-		http.Error(w, "Request trailers are not supported", http.StatusBadRequest)
+		p.replyError(w, r, res, http.StatusBadRequest, "Request trailers are not supported",
+			errors.New("request has trailers"))
 		return
 	}
-	type hdr struct {
-		name, value string
-	}
-	headers := []hdr{
-		{"QUERY_STRING", r.URL.RawQuery},
-		{"REQUEST_METHOD", r.Method},
-		{"CONTENT_TYPE", r.Header.Get("Content-Type")},
-		{"CONTENT_LENGTH", strconv.FormatInt(r.ContentLength, 10)},
-		{"REQUEST_URI", r.RequestURI},
-		{"PATH_INFO", r.URL.Path},
-		{"SERVER_PROTOCOL", r.Proto},
-		{"SERVER_NAME", r.Host},
-	}
-	if r.URL.Scheme == "https" || r.Header.Get("X-Forwarded-Proto") == "https" {
-		headers = append(headers, hdr{"HTTPS", "on"}, hdr{"SERVER_PORT", "443"})
-	} else if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
-		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
-			headers = append(headers, hdr{"SERVER_PORT", port})
+	pathInfo, reqURI := r.URL.Path, requestURI(r)
+	trace := requestTrace{steps: ctxTrace(r.Context())}
+	switch {
+	case reqURI == "*":
+		pathInfo = ""
+	case p.NormalizePath && !p.Passthrough:
+		clean, ok := normalizePath(r.URL)
+		if !ok {
+			p.replyError(w, r, res, http.StatusBadRequest, "Invalid request path",
+				errors.New("request path has encoded traversal sequences"))
+			return
+		}
+		if clean != pathInfo {
+			u := *r.URL
+			u.Path, u.RawPath = clean, ""
+			pathInfo, reqURI = clean, u.RequestURI()
+			trace.rewrites = append(trace.rewrites, "path")
+		}
+	}
+	scriptName := ctxMount(r.Context())
+	if scriptName == "" {
+		scriptName = strings.TrimSuffix(p.MountPoint, "/")
+	}
+	trace.mount = scriptName
+	if scriptName != "" && hasPathPrefix(pathInfo, scriptName) {
+		pathInfo = pathInfo[len(scriptName):]
+	} else if scriptName != "" && strings.HasPrefix(reqURI, "/") {
+		// prefix was stripped before request reached Proxy, like
+		// http.StripPrefix does, restore it for REQUEST_URI
+		if path, _, _ := strings.Cut(reqURI, "?"); !hasPathPrefix(path, scriptName) {
+			reqURI = scriptName + reqURI
+		}
+	}
+	method, body := r.Method, io.Reader(r.Body)
+	if len(p.MethodOverride) != 0 && !p.Passthrough {
+		var err error
+		if method, body, err = p.overrideMethod(r); err != nil {
+			logf("uwsgi request body read: %v", err)
+			p.replyError(w, r, res, http.StatusBadRequest, "", err)
+			return
+		}
+		if method != r.Method {
+			trace.rewrites = append(trace.rewrites, "method")
+		}
+		if !p.methodAllowed(method) {
+			w.Header().Set("Allow", p.allow())
+			p.replyError(w, r, res, http.StatusMethodNotAllowed, "", errMethodNotAllowed)
+			return
+		}
+	}
+	contentLength := r.ContentLength
+	var sendLength int64 // of body sent over connection, see PostBuffering
+	var postFile string
+	var sp *spooled // request body, if spooled
+	requestFilters := p.RequestFilters
+	if p.Passthrough {
+		requestFilters = nil
+	}
+	if len(requestFilters) != 0 || (p.PostBuffering > 0 &&
+		(contentLength < 0 || contentLength > p.PostBuffering)) {
+		for _, fn := range requestFilters {
+			body = fn(body)
+		}
+		memLimit := p.spoolMemory()
+		if p.PostBuffering > 0 {
+			memLimit = p.PostBuffering
+		}
+		var err error
+		if sp, err = spool(body, memLimit, p.PostBufferingDir); err != nil {
+			logf("uwsgi request body spooling: %v", err)
+			p.replyError(w, r, res, http.StatusBadRequest, "", err)
+			return
+		}
+		defer sp.Close()
+		body, contentLength = sp, sp.size
+		if p.PostBuffering > 0 && sp.file != nil {
+			postFile = sp.file.Name()
+			body = http.NoBody
 		}
+	}
+	if postFile == "" {
+		sendLength = contentLength
+	}
+	var vars []Var
+	if p.NginxCompat {
+		vars = p.nginxVars(r, method, reqURI, pathInfo, contentLength)
 	} else {
-		headers = append(headers, hdr{"SERVER_PORT", "80"})
+		vars = []Var{
+			{"QUERY_STRING", r.URL.RawQuery},
+			{"REQUEST_METHOD", method},
+			{"CONTENT_TYPE", r.Header.Get("Content-Type")},
+			{"CONTENT_LENGTH", strconv.FormatInt(contentLength, 10)},
+			{"REQUEST_URI", reqURI},
+			{"PATH_INFO", pathInfo},
+			{"SERVER_PROTOCOL", r.Proto},
+			{"SERVER_NAME", r.Host},
+		}
+		serverAddr, serverPort := localAddr(r)
+		scheme := "http"
+		if p.isHTTPS(r) {
+			scheme = "https"
+			vars = append(vars, Var{"HTTPS", "on"}, Var{"SERVER_PORT", "443"})
+		} else if serverPort != "" {
+			vars = append(vars, Var{"SERVER_PORT", serverPort})
+		} else if _, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); !ok {
+			vars = append(vars, Var{"SERVER_PORT", "80"})
+		}
+		vars = append(vars, Var{"REQUEST_SCHEME", scheme})
+		if serverAddr != "" {
+			vars = append(vars, Var{"SERVER_ADDR", serverAddr})
+		}
+		addr, port := p.remoteAddr(r)
+		if addr != "" {
+			vars = append(vars, Var{"REMOTE_ADDR", addr})
+		}
+		if port != "" {
+			vars = append(vars, Var{"REMOTE_PORT", port})
+		}
+	}
+	if scriptName != "" {
+		vars = append(vars, Var{"SCRIPT_NAME", scriptName})
+	}
+	if p.RequestTimeVars {
+		vars = append(vars, requestTimeVars(res.Start)...)
 	}
-	var hasRemoteAddr bool
-	if s := r.Header.Get("X-Forwarded-For"); s != "" {
-		if i := strings.IndexByte(s, ','); i > 0 {
-			s = s[:i]
+	if p.GeoIP != nil {
+		geo, err := p.geoVars(p.ClientIP(r))
+		if err != nil {
+			logf("uwsgi geoip lookup: %v", err)
 		}
-		headers = append(headers, hdr{"REMOTE_ADDR", s})
-		hasRemoteAddr = true
+		vars = append(vars, geo...)
 	}
-	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		if !hasRemoteAddr {
-			headers = append(headers, hdr{"REMOTE_ADDR", host})
+	if r.TLS != nil && p.TLSVars {
+		vars = append(vars, tlsVars(r.TLS, p.TLSClientCert)...)
+	}
+	if postFile != "" {
+		name := p.PostBufferingVar
+		if name == "" {
+			name = "UWSGI_POSTFILE"
+		}
+		vars = append(vars, Var{name, postFile})
+	}
+	// this is a single request exchange: remove client's hop-by-hop
+	// headers and tell backend not to wait for more requests, unless client
+	// asks to switch protocols
+	upgrade := upgradeProtocol(r)
+	reqHeader := r.Header
+	if p.rewritesForwarded() {
+		reqHeader = reqHeader.Clone()
+		p.setForwarded(reqHeader, r)
+	}
+	httpHeader := reqHeader // for ProtocolHTTP backends, see writeHTTP
+	for _, k := range hopHeaders {
+		if _, ok := reqHeader[k]; ok {
+			reqHeader = reqHeader.Clone()
+			delHopHeaders(reqHeader)
+			break
+		}
+	}
+	if upgrade != "" {
+		reqHeader.Set("Connection", "Upgrade")
+		reqHeader.Set("Upgrade", upgrade)
+	} else if !p.NginxCompat && p.MaxIdleConns <= 0 {
+		vars = append(vars, Var{"HTTP_CONNECTION", "close"})
+	}
+	if p.DeviceClass != nil {
+		if class := p.DeviceClass(r.UserAgent()); class != "" {
+			vars = append(vars, Var{"HTTP_X_DEVICE_CLASS", class})
+		}
+	}
+	if scriptName != "" && !p.Passthrough {
+		var outer string
+		if p.trustHeaders(r) {
+			outer = reqHeader.Get("X-Forwarded-Prefix")
 		}
-		headers = append(headers, hdr{"REMOTE_PORT", port})
+		vars = append(vars, Var{"HTTP_X_FORWARDED_PREFIX", forwardedPrefix(outer, scriptName)})
 	}
-	for k, v := range r.Header {
+	for k, v := range reqHeader {
+		if k == "Content-Length" && contentLength != r.ContentLength {
+			continue
+		}
+		if k == "X-Forwarded-Prefix" && scriptName != "" && !p.Passthrough {
+			continue
+		}
+		if k == "X-Device-Class" && p.DeviceClass != nil {
+			continue
+		}
 		k2 := "HTTP_" + strings.Map(func(r rune) rune {
 			if r == '-' {
 				return '_'
 			}
 			return unicode.ToUpper(r)
 		}, k)
-		h := hdr{k2, strings.Join(v, ", ")}
-		if len(h.name) > maxSize || len(h.value) > maxSize {
-			http.Error(w, fmt.Sprintf("Header %q is too large\n", k),
-				http.StatusRequestHeaderFieldsTooLarge)
+		sep := ", "
+		if strings.HasSuffix(k, "-Bin") {
+			// gRPC binary headers: base64 values, comma-separated
+			sep = ","
+		}
+		h := Var{k2, strings.Join(v, sep)}
+		if len(h.Name) > maxSize || len(h.Value) > maxSize {
+			p.replyError(w, r, res, http.StatusRequestHeaderFieldsTooLarge,
+				fmt.Sprintf("Header %q is too large", k), ErrVarsTooLarge)
 			return
 		}
-		headers = append(headers, h)
+		vars = append(vars, h)
+	}
+	if p.VarMapper != nil {
+		vars = append(vars, p.VarMapper(r)...)
+	}
+	vars = append(vars, ctxVars(r.Context())...)
+	pvars, err := newVars(vars, p.packetSize())
+	if err != nil {
+		p.replyError(w, r, res, http.StatusRequestHeaderFieldsTooLarge, "", err)
+		return
 	}
-	var size int
-	for _, h := range headers {
-		if len(h.name) > maxSize || len(h.value) > maxSize {
-			http.Error(w, http.StatusText(http.StatusRequestHeaderFieldsTooLarge),
-				http.StatusRequestHeaderFieldsTooLarge)
+	if p.ModifyVars != nil {
+		if err := p.ModifyVars(r, pvars); err != nil {
+			code, text := errorStatus(err, http.StatusInternalServerError)
+			if errors.Is(err, ErrVarsTooLarge) {
+				code, text = http.StatusRequestHeaderFieldsTooLarge, ""
+			}
+			logf("uwsgi vars modification: %v", err)
+			p.replyError(w, r, res, code, text, err)
+			return
+		}
+	}
+	if p.Admit != nil {
+		if err := p.Admit(r, pvars); err != nil {
+			code, text := errorStatus(err, http.StatusForbidden)
+			if errors.Is(err, ErrVarsTooLarge) {
+				code, text = http.StatusRequestHeaderFieldsTooLarge, ""
+			}
+			p.replyError(w, r, res, code, text, err)
 			return
 		}
-		size += len(h.name) + len(h.value) + 4
 	}
-	if size > maxSize {
-		http.Error(w, http.StatusText(http.StatusRequestHeaderFieldsTooLarge),
-			http.StatusRequestHeaderFieldsTooLarge)
+	proto, err := p.protocol(r.Context())
+	if err != nil {
+		logf("uwsgi backend protocol detection: %v", err)
+	}
+	if p.Faults != nil {
+		p.Faults.delay(r.Context())
+	}
+	var deadline time.Time // of the whole exchange, zero if unlimited
+	if p.Timeout > 0 {
+		deadline = res.Start.Add(p.Timeout)
+	}
+	dialCtx := withRequest(r.Context(), r)
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithDeadline(dialCtx, deadline)
+		defer cancel()
+	}
+	if p.rejectDown(w, r, res) {
 		return
 	}
-	var conn net.Conn
-	var err error
-	var tempDelay time.Duration
-	for {
-		if conn, err = dial(r.Context()); err == nil {
-			break
-		}
+	res.Phase = PhaseDial
+	dialStart := time.Now()
+	var priority int
+	if p.Priority != nil {
+		priority = p.Priority(r)
+	}
+	conn, wait, err := p.getConn(dialCtx, priority)
+	res.Wait, res.Dial = wait, time.Since(dialStart)-wait
+	if err != nil {
 		if err == context.Canceled {
-			panic(http.ErrAbortHandler)
+			res.Err = err
+			return
 		}
-		if ne, ok := err.(net.Error); ok && ne.Temporary() {
-			if tempDelay == 0 {
-				tempDelay = 5 * time.Millisecond
-			} else {
-				tempDelay *= 2
+		if err == errShed || err == errConnWait {
+			logf("uwsgi backend connect: %v", err)
+			p.replyError(w, r, res, http.StatusServiceUnavailable, "", err)
+			return
+		}
+		if dialCtx.Err() == nil {
+			p.backendResult(nil, false)
+		}
+		logf("uwsgi backend connect (%v): %v", ClassifyDialError(err), err)
+		p.replyError(w, r, res, p.dialPolicy(err).Status, "", err)
+		return
+	}
+	var reuse bool // whether conn can be used for another request
+	defer func() { p.putConn(conn, reuse) }()
+	res.Backend = conn.RemoteAddr().String()
+	if !p.track(conn) {
+		p.replyError(w, r, res, http.StatusServiceUnavailable, "", errDraining)
+		return
+	}
+	defer func() { p.untrack(conn) }()
+	// abort exchange as soon as client goes away, so that backend can
+	// notice it and release its worker
+	stopAbort := abortOnDone(r.Context(), conn)
+	defer func() {
+		if !stopAbort() {
+			reuse = false
+		}
+	}()
+	if p.DisconnectSignal > 0 && proto != ProtocolHTTP {
+		ctx := context.WithoutCancel(r.Context())
+		dial := p.DialContext
+		if tc := asTracked(conn); tc != nil {
+			dial = tc.dial // signal the backend serving the request
+		}
+		stop := context.AfterFunc(r.Context(), func() {
+			if err := sendSignal(ctx, dial, uint8(p.DisconnectSignal)); err != nil {
+				logf("uwsgi disconnect signal: %v", err)
 			}
-			if tempDelay > time.Second {
-				logf("uwsgi backend connect: %v", err)
-				http.Error(w, http.StatusText(http.StatusGatewayTimeout),
-					http.StatusGatewayTimeout)
-				return
+		})
+		defer stop()
+	}
+	if p.Faults != nil && p.Faults.drop() {
+		conn.Close()
+	}
+
+	res.Phase = PhaseWrite
+	keepAlive := upgrade != "" || p.MaxIdleConns > 0 && (proto == ProtocolHTTP || contentLength >= 0)
+	var cb *clientBody // to tell client errors from backend ones
+	if sp == nil && body != http.NoBody {
+		cb = &clientBody{r: body}
+		body = cb
+	}
+	var writeDeadline time.Time
+	for {
+		if p.TraceVar != "" && proto != ProtocolHTTP {
+			if err := pvars.Set(p.TraceVar, trace.encode(res.Backend, res.Retries)); err != nil {
+				logf("uwsgi trace: %v", err)
 			}
-			select {
-			case <-time.After(tempDelay):
-				continue
-			case <-r.Context().Done():
-				panic(http.ErrAbortHandler)
+		}
+		if writeDeadline = earliest(deadline, timeoutAt(p.WriteTimeout)); !writeDeadline.IsZero() {
+			conn.SetWriteDeadline(writeDeadline)
+		}
+		if proto == ProtocolHTTP {
+			err = writeHTTP(conn, r, httpHeader, method, reqURI, body, sendLength, keepAlive)
+		} else if err = writeUwsgi(conn, p.Modifier1, p.Modifier2, pvars.list, pvars.size, body, p.inlineSize(sendLength)); err == nil && !keepAlive {
+			if err := closeWrite(conn); err != nil {
+				logf("uwsgi backend connection half-close: %v", err)
 			}
 		}
-		logf("uwsgi backend connect: %v", err)
-		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
-		return
+		// backend may have closed connection while recycling its
+		// worker, resend request once over a new connection
+		if err == nil || res.Retries > 0 || !backendClosed(err) || r.Context().Err() != nil ||
+			!canResend(method, contentLength, sp) ||
+			(p.RetryBudget != nil && !p.RetryBudget.Withdraw()) {
+			break
+		}
+		fresh, err2 := p.dial(dialCtx)
+		if err2 != nil {
+			logf("uwsgi backend connect (%v): %v", ClassifyDialError(err2), err2)
+			break
+		}
+		// not counted as backend failure unless resending fails too
+		logf("uwsgi request write: %v, resending", err)
+		stopAbort()
+		p.untrack(conn)
+		conn.Close()
+		conn = fresh
+		res.Backend = conn.RemoteAddr().String()
+		res.Retries++
+		if !p.track(conn) {
+			p.replyError(w, r, res, http.StatusServiceUnavailable, "", errDraining)
+			return
+		}
+		stopAbort = abortOnDone(r.Context(), conn)
 	}
-	defer conn.Close()
-
-	uwsgiHeader := make([]byte, 4)
-	binary.LittleEndian.PutUint16(uwsgiHeader[1:3], uint16(size))
-	buf := bufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	buf.Write(uwsgiHeader)
-	for _, hdr := range headers {
-		binary.Write(buf, binary.LittleEndian, uint16(len(hdr.name)))
-		buf.WriteString(hdr.name)
-		binary.Write(buf, binary.LittleEndian, uint16(len(hdr.value)))
-		buf.WriteString(hdr.value)
-	}
-	if _, err := io.Copy(conn, buf); err != nil {
-		logf("uwsgi header packet write: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	if err != nil {
+		if err := r.Context().Err(); err != nil {
+			res.Err = err
+			return
+		}
+		if cb != nil && cb.err != nil {
+			logf("uwsgi request body read: %v", cb.err)
+			p.replyError(w, r, res, http.StatusBadRequest, "", cb.err)
+			return
+		}
+		logf("uwsgi request write: %v", err)
+		if cb.slow(err, writeDeadline) {
+			p.replyError(w, r, res, http.StatusRequestTimeout, "", err)
+			return
+		}
+		p.backendResult(conn, false)
+		if isTimeout(err) {
+			p.replyError(w, r, res, http.StatusGatewayTimeout, "", err)
+			return
+		}
+		p.resetProtocol()
+		p.replyError(w, r, res, http.StatusBadGateway, "", err)
 		return
 	}
-	bufPool.Put(buf)
-	if _, err := io.Copy(conn, r.Body); err != nil {
-		logf("uwsgi body write: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
-		return
+	res.Phase = PhaseHeader
+	var rd io.Reader = conn
+	var ir *idleReader
+	if p.ResponseIdleTimeout > 0 || p.ResponseHeaderTimeout > 0 || !deadline.IsZero() {
+		ir = &idleReader{conn: conn, d: p.ResponseIdleTimeout,
+			deadline: earliest(deadline, timeoutAt(p.ResponseHeaderTimeout))}
+		rd = ir
+	}
+	// limit response headers size, the limit is lifted once they're read
+	headerLimit := &io.LimitedReader{R: rd, N: p.maxResponseHeaderBytes()}
+	br := p.newReader(headerLimit)
+	defer p.putReader(br)
+	var head [5]byte // copy of reply start to diagnose protocol mismatch
+	b, _ := br.Peek(len(head))
+	headLen := copy(head[:], b)
+	resp, err := p.readResponse(br, w, r, method)
+	res.Header = time.Since(res.Start)
+	if ir != nil {
+		ir.deadline = deadline // response headers are read
+	}
+	if err != nil && headerLimit.N <= 0 {
+		err = fmt.Errorf("response headers exceed %d bytes", p.maxResponseHeaderBytes())
 	}
-	resp, err := http.ReadResponse(bufio.NewReader(conn), r)
+	headerLimit.N = math.MaxInt64
 	if err != nil {
+		if err := r.Context().Err(); err != nil {
+			res.Err = err
+			return
+		}
+		if hint := mismatchHint(head[:headLen], proto); hint != "" && !isTimeout(err) {
+			err = fmt.Errorf("%w (%s)", err, hint)
+		}
 		logf("uwsgi response read: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		p.backendResult(conn, false)
+		if isTimeout(err) {
+			p.replyError(w, r, res, http.StatusGatewayTimeout, "", err)
+			return
+		}
+		p.resetProtocol()
+		p.replyError(w, r, res, http.StatusBadGateway, "", err)
+		return
+	}
+	p.backendResult(conn, true)
+	res.Phase = PhaseBody
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if upgrade == "" || !strings.EqualFold(resp.Header.Get("Upgrade"), upgrade) {
+			p.replyError(w, r, res, http.StatusBadGateway, "",
+				errors.New("backend switched protocols unexpectedly"))
+			return
+		}
+		client, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			p.replyError(w, r, res, http.StatusInternalServerError, "", err)
+			return
+		}
+		if err := p.switchProtocols(client, brw, resp, conn, br); err != nil {
+			res.Err = err
+			logf("uwsgi protocol switch: %v", err)
+		}
 		return
 	}
+	backendBody := resp.Body // ModifyResponse may replace it
+	if p.ModifyResponse != nil {
+		resp.Request = r
+		if err := p.ModifyResponse(resp); err != nil {
+			logf("uwsgi response modification: %v", err)
+			code, text := errorStatus(err, http.StatusBadGateway)
+			p.replyError(w, r, res, code, text, err)
+			return
+		}
+	}
 	wHeader := w.Header()
 	for k, v := range resp.Header {
-		wHeader[k] = v
+		if headerAllowed(k, p.ResponseHeaderAllow, p.ResponseHeaderDeny) {
+			wHeader[k] = v
+		}
+	}
+	delHopHeaders(wHeader)
+	wHeader.Del("X-Accel-Buffering") // meant for the proxy, see streamResponse
+	if _, ok := wHeader["Content-Type"]; !ok {
+		switch {
+		case p.DefaultContentType != "":
+			wHeader.Set("Content-Type", p.DefaultContentType)
+		case p.DisableSniffing:
+			wHeader["Content-Type"] = nil // see http.ResponseWriter docs
+		}
+	}
+	addMissingHeaders(wHeader, p.SecurityHeaders)
+	body = resp.Body
+	if p.Faults != nil {
+		body = p.Faults.truncate(body)
+	}
+	if len(p.ResponseFilters) != 0 {
+		wHeader.Del("Content-Length")
+		for _, fn := range p.ResponseFilters {
+			body = fn(body)
+		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	var dst io.Writer = w
+	interval := p.FlushInterval
+	if streamResponse(resp.Header) {
+		interval = -1
+	}
+	if interval != 0 {
+		rc := http.NewResponseController(w)
+		switch err := rc.Flush(); {
+		case err != nil:
+			logf("uwsgi response streaming: %v", err)
+		case interval < 0:
+			dst = flushWriter{w: w, rc: rc}
+		default:
+			dw := &delayedFlushWriter{w: w, rc: rc, d: interval}
+			defer dw.stop()
+			dst = dw
+		}
+	}
+	if _, err := io.Copy(dst, body); err != nil {
+		res.Err = err
+		if ctxErr := r.Context().Err(); ctxErr != nil {
+			res.Err = ctxErr
+		} else if isTimeout(err) {
+			logf("uwsgi response body read: %v", err)
+		}
+		return
+	}
+	reuse = keepAlive && !resp.Close && bodyDone(resp, backendBody) && br.Buffered() == 0
+}
+
+// bodyDone reports whether body of the response has been read to its end, so
+// that connection it was read from can carry another response.
+func bodyDone(resp *http.Response, body io.Reader) bool {
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		return false // delimited by connection close
+	}
+	var b [1]byte
+	n, err := body.Read(b[:])
+	return n == 0 && err == io.EOF
+}
+
+// requestTimeVars returns variables describing request arrival time t.
+func requestTimeVars(t time.Time) []Var {
+	sec, usec := t.Unix(), t.Nanosecond()/1e3
+	return []Var{
+		{"REQUEST_TIME", strconv.FormatInt(sec, 10)},
+		{"REQUEST_TIME_FLOAT", fmt.Sprintf("%d.%06d", sec, usec)},
+		{"MSEC", fmt.Sprintf("%d.%03d", sec, usec/1e3)},
+	}
+}
+
+// readResponse reads backend response to request r that was sent with the
+// given method. Informational (1xx) responses are skipped, except for 103
+// Early Hints which are relayed to the client. Bodies of responses that
+// can't have one (HEAD requests, 204 and 304 statuses) are discarded,
+// even if backend sends them.
+func (p *Proxy) readResponse(br *bufio.Reader, w http.ResponseWriter, r *http.Request, method string) (*http.Response, error) {
+	if method != r.Method {
+		// response framing depends on method, e.g. HEAD responses have
+		// no body
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Method = method
+		r = r2
+	}
+	for {
+		resp, err := http.ReadResponse(br, r)
+		if err != nil {
+			return nil, err
+		}
+		switch code := resp.StatusCode; {
+		case code == http.StatusEarlyHints:
+			h := w.Header()
+			var sent []string
+			for k, v := range resp.Header {
+				if headerAllowed(k, p.ResponseHeaderAllow, p.ResponseHeaderDeny) {
+					h[k] = v
+					sent = append(sent, k)
+				}
+			}
+			w.WriteHeader(code)
+			for _, k := range sent {
+				h.Del(k) // sent with hints, but not meant for final response
+			}
+		case code == http.StatusSwitchingProtocols, code >= 200:
+			return resp, nil
+		}
+	}
+}
+
+// clientBody wraps request body read from the client, so that errors of
+// writing it to the backend caused by the client are not blamed on the
+// backend.
+type clientBody struct {
+	r    io.Reader
+	err  error     // read error other than io.EOF
+	last time.Time // when the last read returned
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.last = time.Now()
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// slow reports whether write error err is a timeout caused by the client
+// sending body so slowly that write deadline expired while waiting for it.
+func (b *clientBody) slow(err error, deadline time.Time) bool {
+	return b != nil && isTimeout(err) && !deadline.IsZero() && b.last.After(deadline)
+}
+
+// writeUwsgi writes uwsgi packet with given modifiers and variables followed
+// by body to w. If inline is positive, it's the size of the body which is
+// sent together with the packet in a single write.
+func writeUwsgi(w io.Writer, modifier1, modifier2 uint8, vars []Var, size int, body io.Reader, inline int64) error {
+	uwsgiHeader := []byte{modifier1, 0, 0, modifier2}
+	binary.LittleEndian.PutUint16(uwsgiHeader[1:3], uint16(size))
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer bufPool.Put(buf)
+	buf.Reset()
+	buf.Write(uwsgiHeader)
+	for _, v := range vars {
+		binary.Write(buf, binary.LittleEndian, uint16(len(v.Name)))
+		buf.WriteString(v.Name)
+		binary.Write(buf, binary.LittleEndian, uint16(len(v.Value)))
+		buf.WriteString(v.Value)
+	}
+	if inline > 0 {
+		if _, err := io.CopyN(buf, body, inline); err != nil {
+			return fmt.Errorf("body read: %w", err)
+		}
+	}
+	if _, err := io.Copy(w, buf); err != nil {
+		return fmt.Errorf("header packet write: %w", err)
+	}
+	if inline > 0 {
+		return nil
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("body write: %w", err)
+	}
+	return nil
+}
+
+// inlineSize returns contentLength if body is small enough to be sent in
+// a single write with the uwsgi packet, or 0 otherwise.
+func (p *Proxy) inlineSize(contentLength int64) int64 {
+	limit := p.SmallBodySize
+	if limit == 0 {
+		limit = 16 << 10
+	}
+	if contentLength > limit {
+		return 0
+	}
+	return contentLength
+}
+
+// newReader returns bufio.Reader of ReadBufferSize size reading from rd,
+// reusing one returned by putReader if possible.
+func (p *Proxy) newReader(rd io.Reader) *bufio.Reader {
+	if br, ok := p.readers.Get().(*bufio.Reader); ok && br.Size() == p.readBufferSize() {
+		br.Reset(rd)
+		return br
+	}
+	return bufio.NewReaderSize(rd, p.readBufferSize())
+}
+
+// putReader releases bufio.Reader obtained from newReader, it must not be
+// used afterwards.
+func (p *Proxy) putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	p.readers.Put(br)
+}
+
+func (p *Proxy) readBufferSize() int {
+	if p.ReadBufferSize > 0 {
+		return p.ReadBufferSize
+	}
+	return 4096
+}
+
+func (p *Proxy) maxResponseHeaderBytes() int64 {
+	if p.MaxResponseHeaderBytes > 0 {
+		return p.MaxResponseHeaderBytes
+	}
+	return 1 << 20
+}
+
+func (p *Proxy) spoolMemory() int64 {
+	if p.SpoolMemory > 0 {
+		return p.SpoolMemory
+	}
+	return 1 << 20
+}
+
+// closeWrite shuts down the writing side of the connection, so that backends
+// reading request body until EOF don't wait for more data. Connections that
+// don't support this directly are unwrapped using their NetConn method, if
+// any (see tls.Conn.NetConn). It's not used for HTTP backends, as some HTTP
+// servers (including Go's) treat EOF as client going away and cancel request
+// processing.
+func closeWrite(conn net.Conn) error {
+	for {
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			if err := c.CloseWrite(); err != nil && !errors.Is(err, syscall.ENOTCONN) {
+				return err
+			}
+			return nil
+		}
+		u, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = u.NetConn()
+	}
+}
+
+// requestURI returns unmodified request-target of the request line, or,
+// if it's not available (i.e. request was not received by http.Server),
+// reconstructs it from the URL.
+func requestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+// delHopHeaders removes hop-by-hop headers, which must not be forwarded by
+// proxies, see RFC 7230, section 6.1. HTTP/2 forbids them altogether.
+func delHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = textproto.TrimString(f); f != "" {
+				h.Del(f)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Var is a variable passed to uWSGI backend.
+type Var struct {
+	Name, Value string
+}
+
+// logFunc returns function logging errors of request r, see ErrorLog.
+func (p *Proxy) logFunc(r *http.Request) func(format string, v ...interface{}) {
+	if p.LogLevel() == LogOff {
+		return func(string, ...interface{}) {}
+	}
+	if p.ErrorLog != nil {
+		return p.ErrorLog.Printf
+	}
+	return logFunc(r)
 }
 
 func logFunc(r *http.Request) func(format string, v ...interface{}) {
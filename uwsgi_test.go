@@ -0,0 +1,628 @@
+package uwsgi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// testBackend is a fake uWSGI backend serving connections made with its dial
+// method over in-memory pipes.
+type testBackend struct {
+	// handle returns raw HTTP response to the request with given
+	// variables and body.
+	handle func(vars map[string]string, body []byte) string
+
+	// keepAlive makes backend serve multiple requests per connection.
+	keepAlive bool
+
+	dials atomic.Int32
+
+	mu   sync.Mutex
+	reqs []map[string]string // variables of requests received
+}
+
+func (b *testBackend) dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	b.dials.Add(1)
+	go b.serve(server)
+	return client, nil
+}
+
+func (b *testBackend) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		vars, err := readVars(br)
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(vars["CONTENT_LENGTH"])
+		if vars["UWSGI_POSTFILE"] != "" {
+			n = 0 // body is read from the file
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(br, body); err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.reqs = append(b.reqs, vars)
+		b.mu.Unlock()
+		if _, err := io.WriteString(conn, b.handle(vars, body)); err != nil || !b.keepAlive {
+			return
+		}
+	}
+}
+
+// lastVars returns variables of the last request received.
+func (b *testBackend) lastVars() map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.reqs) == 0 {
+		return nil
+	}
+	return b.reqs[len(b.reqs)-1]
+}
+
+// readVars reads uwsgi packet with variables.
+func readVars(r io.Reader) (map[string]string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.LittleEndian.Uint16(hdr[1:3]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	next := func() (string, error) {
+		if len(b) < 2 {
+			return "", errors.New("short packet")
+		}
+		n := int(binary.LittleEndian.Uint16(b))
+		if len(b) < 2+n {
+			return "", errors.New("short packet")
+		}
+		s := string(b[2 : 2+n])
+		b = b[2+n:]
+		return s, nil
+	}
+	for len(b) != 0 {
+		k, err := next()
+		if err != nil {
+			return nil, err
+		}
+		v, err := next()
+		if err != nil {
+			return nil, err
+		}
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+func TestPostBuffering(t *testing.T) {
+	const body = "0123456789abcdef"
+	var got string
+	b := &testBackend{handle: func(vars map[string]string, _ []byte) string {
+		data, err := os.ReadFile(vars["UWSGI_POSTFILE"])
+		if err != nil {
+			t.Error(err)
+		}
+		if n, _ := strconv.Atoi(vars["CONTENT_LENGTH"]); n <= len(data) {
+			got = string(data[:n]) // uWSGI reads CONTENT_LENGTH bytes
+		}
+		return "HTTP/1.1 204 No Content\r\n\r\n"
+	}}
+	p := &Proxy{DialContext: b.dial, PostBuffering: 4, PostBufferingDir: t.TempDir()}
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if got != body {
+		t.Fatalf("backend read body %q from post file, want %q", got, body)
+	}
+}
+
+func TestGRPCWeb(t *testing.T) {
+	const frame = "\x00\x00\x00\x00\x02\x08\x01"
+	b := &testBackend{handle: func(vars map[string]string, body []byte) string {
+		if string(body) != frame {
+			t.Errorf("backend got body %q, want %q", body, frame)
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Type: application/grpc-web+proto\r\n" +
+			"Grpc-Status-Details-Bin: AAEC\r\n\r\n" + frame
+	}}
+	p := &Proxy{DialContext: b.dial}
+	r := httptest.NewRequest(http.MethodPost, "/pkg.Service/Stream", strings.NewReader(frame))
+	r.Header.Set("Content-Type", "application/grpc-web+proto")
+	r.Header["X-Trace-Bin"] = []string{"AAEC", "AwQ="}
+	r.Header.Set("X-Grpc-Web", "1")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	vars := b.lastVars()
+	for name, want := range map[string]string{
+		"CONTENT_TYPE":      "application/grpc-web+proto",
+		"HTTP_X_TRACE_BIN":  "AAEC,AwQ=", // base64 values must not have spaces
+		"HTTP_X_GRPC_WEB":   "1",
+		"HTTP_CONTENT_TYPE": "application/grpc-web+proto",
+	} {
+		if vars[name] != want {
+			t.Errorf("%s = %q, want %q", name, vars[name], want)
+		}
+	}
+	if !w.Flushed {
+		t.Error("gRPC-Web response was not streamed")
+	}
+	if got := w.Header().Get("Grpc-Status-Details-Bin"); got != "AAEC" {
+		t.Errorf("got Grpc-Status-Details-Bin %q, want %q", got, "AAEC")
+	}
+	if got := w.Body.String(); got != frame {
+		t.Errorf("got body %q, want %q", got, frame)
+	}
+}
+
+// BenchmarkWriteUwsgi compares sending small body in a single write with the
+// variables packet against streaming it after the packet, over unix socket.
+func BenchmarkWriteUwsgi(b *testing.B) {
+	ln, err := net.Listen("unix", b.TempDir()+"/sock")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	vars := []Var{
+		{"REQUEST_METHOD", "POST"},
+		{"REQUEST_URI", "/api/orders"},
+		{"PATH_INFO", "/api/orders"},
+		{"CONTENT_TYPE", "application/json"},
+		{"CONTENT_LENGTH", "2048"},
+		{"HTTP_HOST", "example.com"},
+	}
+	pvars, err := newVars(vars, maxSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := strings.Repeat("x", 2048)
+	for _, bc := range []struct {
+		name   string
+		inline int64
+	}{
+		{"inline", int64(len(body))},
+		{"streaming", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// io.Copy takes shortcut for *strings.Reader, hide it
+				// like it's hidden for request bodies
+				body := struct{ io.Reader }{strings.NewReader(body)}
+				err := writeUwsgi(conn, 0, 0, pvars.list, pvars.size, body, bc.inline)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	for _, tc := range []struct {
+		header int // size of header value
+		code   int
+	}{
+		{100, http.StatusOK},
+		{2000, http.StatusBadGateway},
+	} {
+		b := &testBackend{handle: func(map[string]string, []byte) string {
+			return "HTTP/1.1 200 OK\r\nX-Big: " + strings.Repeat("x", tc.header) +
+				"\r\nContent-Length: 2\r\n\r\nok"
+		}}
+		p := &Proxy{DialContext: b.dial, MaxResponseHeaderBytes: 1024}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != tc.code {
+			t.Errorf("header of %d bytes: got status %d, want %d", tc.header, w.Code, tc.code)
+		}
+	}
+}
+
+func TestResponseHeaderPolicy(t *testing.T) {
+	b := &testBackend{handle: func(map[string]string, []byte) string {
+		return "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nX-Debug-Sql: 12\r\n" +
+			"X-Runtime: 0.1\r\nContent-Length: 2\r\n\r\nok"
+	}}
+	p := &Proxy{DialContext: b.dial, ResponseHeaderAllow: []string{"Content-*"}}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "42") // set by middleware
+		p.ServeHTTP(w, r)
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	for name, want := range map[string]string{
+		"Content-Type": "text/plain",
+		"X-Request-Id": "42",
+		"X-Debug-Sql":  "",
+		"X-Runtime":    "",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// hintsRecorder is httptest.ResponseRecorder that also records headers of
+// informational responses.
+type hintsRecorder struct {
+	*httptest.ResponseRecorder
+	hints []http.Header
+}
+
+func (w *hintsRecorder) WriteHeader(code int) {
+	if code >= 100 && code < 200 {
+		w.hints = append(w.hints, w.Header().Clone())
+		return
+	}
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func TestReadResponse(t *testing.T) {
+	const next = "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nnext"
+	for _, tc := range []struct {
+		name     string
+		method   string
+		response string
+		code     int
+		body     string
+		hints    int  // number of 103 responses relayed
+		reused   bool // whether connection is reused for the next request
+	}{
+		{"204", http.MethodGet, "HTTP/1.1 204 No Content\r\n\r\n",
+			http.StatusNoContent, "", 0, true},
+		{"204 with body", http.MethodGet, "HTTP/1.1 204 No Content\r\n\r\nstray",
+			http.StatusNoContent, "", 0, false},
+		{"304", http.MethodGet, "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n",
+			http.StatusNotModified, "", 0, true},
+		{"304 with body", http.MethodGet, "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\nstray",
+			http.StatusNotModified, "", 0, false},
+		{"HEAD", http.MethodHead, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+			http.StatusOK, "", 0, true},
+		{"HEAD with body", http.MethodHead, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nstray",
+			http.StatusOK, "", 0, false},
+		{"100 skipped", http.MethodGet, "HTTP/1.1 100 Continue\r\n\r\n" +
+			"HTTP/1.1 102 Processing\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			http.StatusOK, "ok", 0, true},
+		{"103 relayed", http.MethodGet, "HTTP/1.1 103 Early Hints\r\nLink: </a.css>; rel=preload\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			http.StatusOK, "ok", 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var n atomic.Int32
+			b := &testBackend{keepAlive: true, handle: func(map[string]string, []byte) string {
+				if n.Add(1) == 1 {
+					return tc.response
+				}
+				return next
+			}}
+			p := &Proxy{DialContext: b.dial, MaxIdleConns: 1}
+			w := &hintsRecorder{ResponseRecorder: httptest.NewRecorder()}
+			p.ServeHTTP(w, httptest.NewRequest(tc.method, "/", nil))
+			if w.Code != tc.code {
+				t.Fatalf("got status %d, want %d", w.Code, tc.code)
+			}
+			if got := w.Body.String(); got != tc.body {
+				t.Fatalf("got body %q, want %q", got, tc.body)
+			}
+			if len(w.hints) != tc.hints {
+				t.Fatalf("got %d informational responses, want %d", len(w.hints), tc.hints)
+			}
+			for _, h := range w.hints {
+				if h.Get("Link") == "" {
+					t.Fatal("103 response has no Link header")
+				}
+			}
+			if got := w.Header().Get("Link"); got != "" {
+				t.Fatalf("final response has Link header %q from 103 response", got)
+			}
+
+			w2 := httptest.NewRecorder()
+			p.ServeHTTP(w2, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w2.Code != http.StatusOK || w2.Body.String() != "next" {
+				t.Fatalf("next request: got status %d, body %q", w2.Code, w2.Body)
+			}
+			wantDials := int32(2)
+			if tc.reused {
+				wantDials = 1
+			}
+			if got := b.dials.Load(); got != wantDials {
+				t.Fatalf("backend dialed %d times, want %d", got, wantDials)
+			}
+		})
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	const auth = "AWS4-HMAC-SHA256 Credential=AKID/20240101/us-east-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=fe5f80f77d5fa3beca038a248ff027d0445342fe2855ddc963176630326f1024"
+	for _, tc := range []struct {
+		name   string
+		proxy  *Proxy
+		prefix string // stripped with http.StripPrefix
+		target string
+		header http.Header
+		want   map[string]string // variables, empty value means unset
+	}{
+		{
+			name:   "raw target",
+			proxy:  &Proxy{Passthrough: true},
+			target: "/bucket/a%2Fb/c+d%7E?x=a%20b+c&y=%2B&z",
+			want: map[string]string{
+				"REQUEST_URI":  "/bucket/a%2Fb/c+d%7E?x=a%20b+c&y=%2B&z",
+				"QUERY_STRING": "x=a%20b+c&y=%2B&z",
+				"PATH_INFO":    "/bucket/a/b/c+d~",
+			},
+		},
+		{
+			name:   "signed headers",
+			proxy:  &Proxy{Passthrough: true},
+			target: "/",
+			header: http.Header{
+				"Authorization":        {auth},
+				"X-Amz-Date":           {"20240101T000000Z"},
+				"X-Amz-Content-Sha256": {"UNSIGNED-PAYLOAD"},
+				"X-Hub-Signature-256":  {"sha256=0a1b"},
+				"X-Meta":               {"a,  b", "c"},
+			},
+			want: map[string]string{
+				"HTTP_AUTHORIZATION":        auth,
+				"HTTP_X_AMZ_DATE":           "20240101T000000Z",
+				"HTTP_X_AMZ_CONTENT_SHA256": "UNSIGNED-PAYLOAD",
+				"HTTP_X_HUB_SIGNATURE_256":  "sha256=0a1b",
+				"HTTP_X_META":               "a,  b, c",
+			},
+		},
+		{
+			name:   "mount point",
+			proxy:  &Proxy{Passthrough: true, MountPoint: "/app"},
+			target: "/app/a%2Fb?x=+",
+			want: map[string]string{
+				"REQUEST_URI":  "/app/a%2Fb?x=+",
+				"QUERY_STRING": "x=+",
+				"SCRIPT_NAME":  "/app",
+				"PATH_INFO":    "/a/b",
+			},
+		},
+		{
+			name:   "mount point with StripPrefix",
+			proxy:  &Proxy{Passthrough: true, MountPoint: "/app"},
+			prefix: "/app",
+			target: "/app/a%2Fb?x=+",
+			want: map[string]string{
+				"REQUEST_URI": "/app/a%2Fb?x=+",
+				"SCRIPT_NAME": "/app",
+				"PATH_INFO":   "/a/b",
+			},
+		},
+		{
+			name:   "forwarding headers",
+			proxy:  &Proxy{Passthrough: true, MountPoint: "/app", ForwardedHeaders: true},
+			target: "/app/",
+			header: http.Header{
+				"X-Forwarded-Prefix": {"/outer"},
+				"X-Forwarded-For":    {"192.0.2.1"},
+			},
+			want: map[string]string{
+				"HTTP_X_FORWARDED_PREFIX": "/outer",
+				"HTTP_X_FORWARDED_FOR":    "192.0.2.1",
+				"HTTP_X_FORWARDED_PROTO":  "",
+				"HTTP_FORWARDED":          "",
+			},
+		},
+		{
+			name:   "forwarding headers without passthrough",
+			proxy:  &Proxy{MountPoint: "/app", ForwardedHeaders: true},
+			target: "/app/",
+			header: http.Header{
+				"X-Forwarded-Prefix": {"/outer"},
+				"X-Forwarded-For":    {"192.0.2.1"},
+			},
+			want: map[string]string{
+				"HTTP_X_FORWARDED_PREFIX": "/outer/app",
+				"HTTP_X_FORWARDED_FOR":    "192.0.2.1, 192.0.2.2",
+				"HTTP_X_FORWARDED_PROTO":  "http",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &testBackend{handle: okResponse}
+			p := tc.proxy
+			p.DialContext = b.dial
+			var h http.Handler = p
+			if tc.prefix != "" {
+				h = http.StripPrefix(tc.prefix, h)
+			}
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			r.RemoteAddr = "192.0.2.2:1234"
+			for k, v := range tc.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			vars := b.lastVars()
+			for name, want := range tc.want {
+				if got := vars[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedPrefix(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	for _, tc := range []struct {
+		name   string
+		proxy  *Proxy
+		remote string
+		header string
+		want   string
+	}{
+		{name: "trusted peer", proxy: &Proxy{TrustedProxies: trusted},
+			remote: "10.0.0.1:1234", header: "/outer/", want: "/outer/app"},
+		{name: "trusted peer, first of several", proxy: &Proxy{TrustedProxies: trusted},
+			remote: "10.0.0.1:1234", header: "/outer, /other", want: "/outer/app"},
+		{name: "untrusted peer", proxy: &Proxy{TrustedProxies: trusted},
+			remote: "192.0.2.1:1234", header: "/evil", want: "/app"},
+		{name: "TrustIgnore", proxy: &Proxy{ForwardedTrust: TrustIgnore},
+			remote: "10.0.0.1:1234", header: "/outer", want: "/app"},
+		{name: "no header", proxy: &Proxy{TrustedProxies: trusted},
+			remote: "10.0.0.1:1234", want: "/app"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &testBackend{handle: okResponse}
+			tc.proxy.DialContext = b.dial
+			tc.proxy.MountPoint = "/app"
+			r := httptest.NewRequest(http.MethodGet, "/app/x", nil)
+			r.RemoteAddr = tc.remote
+			if tc.header != "" {
+				r.Header.Set("X-Forwarded-Prefix", tc.header)
+			}
+			w := httptest.NewRecorder()
+			tc.proxy.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := b.lastVars()["HTTP_X_FORWARDED_PREFIX"]; got != tc.want {
+				t.Fatalf("got X-Forwarded-Prefix %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// slowReader returns the contents of s after a delay.
+type slowReader struct {
+	delay time.Duration
+	r     io.Reader
+}
+
+func (r *slowReader) Read(b []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(b)
+}
+
+func TestWriteErrors(t *testing.T) {
+	brokenBackend := func(ctx context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	for _, tc := range []struct {
+		name    string
+		dial    DialFunc
+		body    io.Reader
+		code    int
+		healthy bool // whether backend is healthy afterwards
+	}{
+		{"client body error", (&testBackend{handle: okResponse}).dial,
+			io.MultiReader(strings.NewReader("abc"), iotest.ErrReader(io.ErrUnexpectedEOF)),
+			http.StatusBadRequest, true},
+		{"slow client", (&testBackend{handle: okResponse}).dial,
+			&slowReader{delay: 50 * time.Millisecond, r: strings.NewReader("hello")},
+			http.StatusRequestTimeout, true},
+		{"backend failure", brokenBackend, strings.NewReader("hello"),
+			http.StatusBadGateway, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Proxy{DialContext: tc.dial, MaxFails: 1, WriteTimeout: 20 * time.Millisecond}
+			r := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(tc.body))
+			r.ContentLength = 5
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Code != tc.code {
+				t.Fatalf("got status %d, want %d", w.Code, tc.code)
+			}
+			if got := p.BackendStatus().Healthy; got != tc.healthy {
+				t.Fatalf("got healthy %t, want %t", got, tc.healthy)
+			}
+		})
+	}
+}
+
+// closedConn is a backend connection closed by the backend, like uWSGI does
+// when recycling its worker.
+type closedConn struct{ net.Conn }
+
+func (closedConn) Write([]byte) (int, error) { return 0, syscall.EPIPE }
+
+func TestResend(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		broken  int32 // number of connections closed by the backend
+		code    int
+		healthy bool
+	}{
+		{"resend succeeds", 1, http.StatusOK, true},
+		{"resend fails", 2, http.StatusBadGateway, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &testBackend{handle: okResponse}
+			var dials atomic.Int32
+			dial := func(ctx context.Context) (net.Conn, error) {
+				conn, err := b.dial(ctx)
+				if dials.Add(1) <= tc.broken {
+					return closedConn{conn}, err
+				}
+				return conn, err
+			}
+			p := &Proxy{DialContext: dial, MaxFails: 1}
+			w := httptest.NewRecorder()
+			res := p.ServeHTTPResult(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tc.code {
+				t.Fatalf("got status %d, want %d", w.Code, tc.code)
+			}
+			if res.Retries != 1 {
+				t.Fatalf("got %d retries, want 1", res.Retries)
+			}
+			if got := p.BackendStatus().Healthy; got != tc.healthy {
+				t.Fatalf("got healthy %t, want %t", got, tc.healthy)
+			}
+		})
+	}
+}
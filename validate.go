@@ -0,0 +1,58 @@
+package uwsgi
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Validate checks Proxy configuration for errors, it's meant to be called on
+// startup.
+func (p *Proxy) Validate() error {
+	var errs []error
+	if p.DialContext == nil {
+		errs = append(errs, errors.New("DialContext is not set"))
+	}
+	if err := validateBufferSize(p.BufferSize); err != nil {
+		errs = append(errs, err)
+	}
+	if p.MaxResponseHeaderBytes < 0 {
+		errs = append(errs, fmt.Errorf("negative MaxResponseHeaderBytes %d", p.MaxResponseHeaderBytes))
+	}
+	if p.Passthrough && (p.NormalizePath || len(p.MethodOverride) != 0 || len(p.RequestFilters) != 0) {
+		errs = append(errs, errors.New("NormalizePath, MethodOverride, and RequestFilters can't be used with Passthrough"))
+	}
+	if p.DisconnectSignal < 0 || p.DisconnectSignal > 255 {
+		errs = append(errs, fmt.Errorf("DisconnectSignal %d is out of 0-255 range", p.DisconnectSignal))
+	}
+	if p.Modifier1 == modifierPing || p.Modifier1 == modifierSignal {
+		errs = append(errs, fmt.Errorf("Modifier1 %d is reserved for uwsgi control packets", p.Modifier1))
+	}
+	if p.ForwardedTrust == TrustFirstUntrusted && len(p.TrustedProxies) == 0 {
+		errs = append(errs, errors.New("TrustFirstUntrusted mode requires TrustedProxies"))
+	}
+	return errors.Join(errs...)
+}
+
+// validateBufferSize checks value of Proxy.BufferSize.
+func validateBufferSize(size int) error {
+	switch {
+	case size > maxSize:
+		return fmt.Errorf("BufferSize %d exceeds max uwsgi packet size %d", size, maxSize)
+	case size < 0:
+		return fmt.Errorf("negative BufferSize %d", size)
+	case size > 0 && size < minBufferSize:
+		return fmt.Errorf("BufferSize %d is too small to fit common requests, "+
+			"it should match backend's --buffer-size option", size)
+	}
+	return nil
+}
+
+// packetSize returns max size of variables packet payload.
+func (p *Proxy) packetSize() int {
+	if p.BufferSize > 0 && p.BufferSize < maxSize {
+		return p.BufferSize
+	}
+	return maxSize
+}
+
+const minBufferSize = 1024
@@ -0,0 +1,109 @@
+package uwsgi
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrVarsTooLarge is returned when request variables don't fit into uwsgi
+// packet.
+var ErrVarsTooLarge = errors.New("request variables do not fit into uwsgi packet")
+
+// Vars is an ordered list of uwsgi request variables, keeping track of their
+// encoded size: changes that would make variables not fit into the backend
+// buffer fail with an error wrapping ErrVarsTooLarge, so hooks can't
+// accidentally produce a request the backend would reject.
+type Vars struct {
+	list  []Var
+	size  int // encoded size of list
+	limit int
+}
+
+// newVars returns Vars with the given variables and packet size limit, or an
+// error if they don't fit.
+func newVars(list []Var, limit int) (*Vars, error) {
+	v := &Vars{list: list, limit: limit}
+	for _, x := range list {
+		if len(x.Name) > maxSize || len(x.Value) > maxSize {
+			return nil, fmt.Errorf("variable %s: %w", x.Name, ErrVarsTooLarge)
+		}
+		v.size += varSize(x.Name, x.Value)
+	}
+	if v.size > limit {
+		return nil, ErrVarsTooLarge
+	}
+	return v, nil
+}
+
+// Get returns value of the first variable with the given name.
+func (v *Vars) Get(name string) (value string, ok bool) {
+	for _, x := range v.list {
+		if x.Name == name {
+			return x.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set sets variable value, replacing existing variables with the same name
+// or adding a new one to the end of the list.
+func (v *Vars) Set(name, value string) error {
+	i := v.index(name)
+	size := v.size + varSize(name, value)
+	if i != -1 {
+		size -= varSize(name, v.list[i].Value)
+	}
+	if len(name) > maxSize || len(value) > maxSize || size > v.limit {
+		return fmt.Errorf("variable %s: %w", name, ErrVarsTooLarge)
+	}
+	if i == -1 {
+		v.list = append(v.list, Var{name, value})
+		v.size = size
+		return nil
+	}
+	v.list[i].Value = value
+	v.size = size
+	v.del(name, i+1)
+	return nil
+}
+
+// Del removes all variables with the given name.
+func (v *Vars) Del(name string) { v.del(name, 0) }
+
+// del removes variables with the given name starting from index i.
+func (v *Vars) del(name string, i int) {
+	out := v.list[:i]
+	for _, x := range v.list[i:] {
+		if x.Name == name {
+			v.size -= varSize(x.Name, x.Value)
+			continue
+		}
+		out = append(out, x)
+	}
+	clear(v.list[len(out):])
+	v.list = out
+}
+
+// List returns a copy of variables list.
+func (v *Vars) List() []Var { return append([]Var(nil), v.list...) }
+
+// Len returns number of variables.
+func (v *Vars) Len() int { return len(v.list) }
+
+// Size returns size of variables encoded into uwsgi packet.
+func (v *Vars) Size() int { return v.size }
+
+// Limit returns max size of variables encoded into uwsgi packet.
+func (v *Vars) Limit() int { return v.limit }
+
+func (v *Vars) index(name string) int {
+	for i, x := range v.list {
+		if x.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// varSize returns size of the variable encoded into uwsgi packet.
+func varSize(name, value string) int { return len(name) + len(value) + 4 }
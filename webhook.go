@@ -0,0 +1,155 @@
+package uwsgi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookScheme is a webhook signature scheme, see Webhook.
+type WebhookScheme int
+
+const (
+	// WebhookGitHub is GitHub-style signature: X-Hub-Signature-256 header
+	// holds "sha256=" followed by hex-encoded HMAC-SHA256 of the body.
+	WebhookGitHub WebhookScheme = iota
+	// WebhookStripe is Stripe-style signature: Stripe-Signature header
+	// holds timestamp t and one or more v1 signatures, each being
+	// hex-encoded HMAC-SHA256 of the timestamp, ".", and the body.
+	WebhookStripe
+)
+
+// Webhook verifies signatures of webhook requests, passing only requests
+// with valid signatures to the wrapped handler, which shields slow backends
+// from floods of forged requests. Requests with missing or invalid
+// signatures get 401 Unauthorized reply, requests with bodies larger than
+// MaxBodySize get 413 Request Entity Too Large reply.
+//
+// Use Webhook.Handler to wrap handler being protected.
+type Webhook struct {
+	Scheme WebhookScheme
+
+	// Secret returns shared secret to verify request signature with. If it
+	// returns an error, request is rejected with the status code from
+	// *StatusError, or 500 Internal Server Error status for other errors.
+	// If Secret is nil or returns empty secret, which would let anyone
+	// compute valid signatures, request is rejected with 500 Internal Server
+	// Error status too.
+	Secret func(*http.Request) ([]byte, error)
+
+	// MaxBodySize is the max size of request body, 1 MiB if zero.
+	MaxBodySize int64
+
+	// Tolerance is the max age of WebhookStripe signature timestamp,
+	// 5 minutes if zero.
+	Tolerance time.Duration
+}
+
+// Handler returns handler that passes requests with valid signatures to h.
+func (wh *Webhook) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var secret []byte
+		err := errNoSecret
+		if wh.Secret != nil {
+			secret, err = wh.Secret(r)
+		}
+		if err == nil && len(secret) == 0 {
+			err = errNoSecret
+		}
+		if err != nil {
+			logFunc(r)("uwsgi webhook secret: %v", err)
+			code, text := errorStatus(err, http.StatusInternalServerError)
+			http.Error(w, text, code)
+			return
+		}
+		limit := wh.MaxBodySize
+		if limit <= 0 {
+			limit = 1 << 20
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > limit {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := wh.verify(r.Header, body, secret, time.Now()); err != nil {
+			http.Error(w, "Invalid webhook signature", http.StatusUnauthorized)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Body = io.NopCloser(bytes.NewReader(body))
+		r2.ContentLength = int64(len(body))
+		r2.TransferEncoding = nil
+		h.ServeHTTP(w, r2)
+	})
+}
+
+func (wh *Webhook) verify(h http.Header, body, secret []byte, now time.Time) error {
+	switch wh.Scheme {
+	case WebhookGitHub:
+		sig, ok := strings.CutPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok || !validMAC(secret, sig, body) {
+			return errBadSignature
+		}
+		return nil
+	case WebhookStripe:
+		var ts string
+		var sigs []string
+		for _, kv := range strings.Split(h.Get("Stripe-Signature"), ",") {
+			k, v, _ := strings.Cut(kv, "=")
+			switch k {
+			case "t":
+				ts = v
+			case "v1":
+				sigs = append(sigs, v)
+			}
+		}
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return errBadSignature
+		}
+		tolerance := wh.Tolerance
+		if tolerance <= 0 {
+			tolerance = 5 * time.Minute
+		}
+		if d := now.Sub(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+			return errBadSignature
+		}
+		payload := append([]byte(ts+"."), body...)
+		for _, sig := range sigs {
+			if validMAC(secret, sig, payload) {
+				return nil
+			}
+		}
+		return errBadSignature
+	}
+	return errors.New("unsupported webhook scheme")
+}
+
+// validMAC reports whether sig is hex-encoded HMAC-SHA256 of msg.
+func validMAC(secret []byte, sig string, msg []byte) bool {
+	want, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+var (
+	errBadSignature = errors.New("invalid webhook signature")
+	errNoSecret     = errors.New("webhook secret is not set")
+)
@@ -0,0 +1,157 @@
+package uwsgi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	secret := []byte("s3cret")
+	mac := func(msg string) string {
+		m := hmac.New(sha256.New, secret)
+		io.WriteString(m, msg)
+		return hex.EncodeToString(m.Sum(nil))
+	}
+	const body = `{"event":"push"}`
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	for _, tc := range []struct {
+		name    string
+		scheme  WebhookScheme
+		secret  func(*http.Request) ([]byte, error)
+		headers map[string]string
+		body    string
+		code    int
+	}{
+		{
+			name:    "valid GitHub signature",
+			scheme:  WebhookGitHub,
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + mac(body)},
+			code:    http.StatusOK,
+		},
+		{
+			name:    "valid Stripe signature",
+			scheme:  WebhookStripe,
+			headers: map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + mac("garbage") + ",v1=" + mac(ts+"."+body)},
+			code:    http.StatusOK,
+		},
+		{
+			name:    "GitHub tampered body",
+			scheme:  WebhookGitHub,
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + mac(body)},
+			body:    `{"event":"delete"}`,
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:    "Stripe tampered body",
+			scheme:  WebhookStripe,
+			headers: map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + mac(ts+"."+body)},
+			body:    `{"event":"delete"}`,
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:   "GitHub missing header",
+			scheme: WebhookGitHub,
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:    "GitHub garbled header",
+			scheme:  WebhookGitHub,
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=zz" + mac(body)[2:]},
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:    "GitHub header without prefix",
+			scheme:  WebhookGitHub,
+			headers: map[string]string{"X-Hub-Signature-256": mac(body)},
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:   "Stripe missing header",
+			scheme: WebhookStripe,
+			code:   http.StatusUnauthorized,
+		},
+		{
+			name:    "Stripe garbled timestamp",
+			scheme:  WebhookStripe,
+			headers: map[string]string{"Stripe-Signature": "t=now,v1=" + mac("now."+body)},
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:    "Stripe timestamp outside tolerance",
+			scheme:  WebhookStripe,
+			headers: map[string]string{"Stripe-Signature": "t=" + old + ",v1=" + mac(old+"."+body)},
+			code:    http.StatusUnauthorized,
+		},
+		{
+			name:    "oversized body",
+			scheme:  WebhookGitHub,
+			body:    strings.Repeat("x", 101),
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + mac(strings.Repeat("x", 101))},
+			code:    http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "empty secret",
+			scheme:  WebhookGitHub,
+			secret:  func(*http.Request) ([]byte, error) { return nil, nil },
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + hex.EncodeToString(hmac.New(sha256.New, nil).Sum(nil))},
+			body:    " ",
+			code:    http.StatusInternalServerError,
+		},
+		{
+			name:   "secret error",
+			scheme: WebhookGitHub,
+			secret: func(*http.Request) ([]byte, error) {
+				return nil, &StatusError{Code: http.StatusNotFound}
+			},
+			code: http.StatusNotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			wh := &Webhook{Scheme: tc.scheme, MaxBodySize: 100, Secret: tc.secret}
+			if wh.Secret == nil {
+				wh.Secret = func(*http.Request) ([]byte, error) { return secret, nil }
+			}
+			var got string
+			h := wh.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				got = string(b)
+			}))
+			reqBody := tc.body
+			if reqBody == "" {
+				reqBody = body
+			}
+			r := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(reqBody))
+			for k, v := range tc.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.code {
+				t.Fatalf("got status %d, want %d", w.Code, tc.code)
+			}
+			if tc.code == http.StatusOK && got != reqBody {
+				t.Fatalf("handler got body %q, want %q", got, reqBody)
+			}
+		})
+	}
+}
+
+func TestWebhookNilSecret(t *testing.T) {
+	h := (&Webhook{}).Handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Fatal("request passed without secret")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader("{}")))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,50 @@
+package uwsgi
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// statusWriter is a http.ResponseWriter recording response status and the
+// number of body bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if http.NewResponseController(w.ResponseWriter).Flush() == nil && w.status == 0 {
+		w.status = http.StatusOK
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, see http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// Hijack lets http.ResponseController take over the underlying connection,
+// it records response status as 101 Switching Protocols.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}